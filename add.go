@@ -1,46 +1,306 @@
-package main
+package vault
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+import (
+	"github.com/dgraph-io/badger"
 	"golang.org/x/crypto/openpgp/packet"
 )
 
-func AddCache(ctx *LocalContext, fns []string) []string {
+// Get the path of fn relative to the vault directory, separated by /
+func vaultRelativePath(baseDir, fn string) (string, error) {
+	absBase, err := filepath.Abs(baseDir)
+	if err != nil {
+		return "", err
+	}
+	absPath, err := filepath.Abs(fn)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(absBase, absPath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// localFile is a file to add, by its path to open and its path relative to
+// the vault directory which its records are keyed with
+type localFile struct {
+	path string
+	rel  string
+}
+
+// Get the path of fn, relative to the working directory, relative to the
+// vault directory instead
+// Return UsageError if fn is outside the vault
+func resolveVaultPath(baseDir, fn string) (string, error) {
+	rel, err := vaultRelativePath(baseDir, fn)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", &UsageError{msg: fn + " is outside the vault"}
+	}
+	return rel, nil
+}
+
+// Get the local file of fn, which must be under the vault directory
+func newLocalFile(baseDir, fn string) (localFile, error) {
+	rel, err := resolveVaultPath(baseDir, fn)
+	if err != nil {
+		return localFile{}, err
+	}
+	return localFile{path: fn, rel: rel}, nil
+}
+
+// Expand the directories in fns into the regular files under them which the
+// matcher accepts
+// The config folder is never walked, and files named in fns are kept as they
+// are
+func expandPaths(baseDir string, fns []string, m *Matcher) ([]localFile, error) {
+	files := []localFile{}
+	for _, fn := range fns {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			file, err := newLocalFile(baseDir, fn)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, file)
+			continue
+		}
+		if _, err := newLocalFile(baseDir, fn); err != nil {
+			return nil, err
+		}
+		err = filepath.Walk(fn, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := vaultRelativePath(baseDir, path)
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if info.Name() == CONF_DIR || (path != fn && m.SkipDir(rel)) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.Mode().IsRegular() && m.Match(rel) {
+				files = append(files, localFile{path: path, rel: rel})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// AddOptions select the files added when a directory is walked
+type AddOptions struct {
+	Include  []string  // only add the files matching one of the patterns
+	Exclude  []string  // skip the files matching one of the patterns
+	Progress io.Writer // progress messages are written to it, nil for none
+}
+
+// Add the files and directories to the vault
+// Directories are walked, honouring the .vaultignore file of the vault and
+// the include and exclude patterns
+// Return the paths of the newly encrypted cache files
+func (v *Vault) Add(ctx context.Context, fns []string, opts AddOptions) ([]string, error) {
+	baseDir := v.baseDirectory()
+	ignores, err := readIgnoreFile(makePath(baseDir, IGNORE_FILE))
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", IGNORE_FILE, err)
+	}
+	m, err := NewMatcher(ignores, opts.Include, opts.Exclude)
+	if err != nil {
+		return nil, &UsageError{msg: "invalid pattern: " + err.Error()}
+	}
+	files, err := expandPaths(baseDir, fns, m)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		progressf(opts.Progress, "Nothing to add\n")
+	}
+	kv, err := LoadBadger(makePath(baseDir, CONF_DIR, DB))
+	if err != nil {
+		return nil, err
+	}
+	defer kv.Close()
+	lc, err := NewLocalContext(v, kv, true)
+	if err != nil {
+		return nil, err
+	}
+	return addCache(ctx, &lc, kv, files, opts.Progress)
+}
+
+// AddCache encrypts the files into the cache folder and records them
+// A file whose status is unchanged since it was last added is skipped without
+// being read, and a file whose content is already cached or pushed is not
+// encrypted again
+// The files are added one by one until the context is done
+// The files are recorded by their path relative to the vault directory, so
+// they must be under it
+// Return the paths of the newly encrypted cache files
+func AddCache(ctx context.Context, lc *LocalContext, fns []string) ([]string, error) {
+	files := []localFile{}
+	for _, fn := range fns {
+		file, err := newLocalFile(lc.baseDirectory(), fn)
+		if err != nil {
+			return []string{}, err
+		}
+		files = append(files, file)
+	}
+	kv, err := LoadBadger(makePath(lc.baseDirectory(), CONF_DIR, DB))
+	if err != nil {
+		return nil, err
+	}
+	defer kv.Close()
+	return addCache(ctx, lc, kv, files, nil)
+}
+
+// Encrypt the local files into the cache folder and record them in the kv,
+// as AddCache, and report the unchanged files to progress
+func addCache(ctx context.Context, lc *LocalContext, kv *badger.KV, files []localFile, progress io.Writer) ([]string, error) {
 	pathList := []string{}
-	if len(fns) == 0 {
-		return pathList
+	if len(files) == 0 {
+		return pathList, nil
 	}
 	defaultConfig := &packet.Config{
 		DefaultCompressionAlgo: 1,
 		CompressionConfig:      &packet.CompressionConfig{Level: 5},
 	}
-	baseDir := ctx.baseDirectory()
+	baseDir := lc.baseDirectory()
 	cacheDir := makePath(baseDir, CONF_DIR, CACHE)
-	dbDir := makePath(baseDir, CONF_DIR, DB)
+	// a file can only be a duplicate of a recorded file of the same size
+	sizes := make(map[int64]bool)
+	err := forEachVaultFile(kv, func(key string, vf VaultFile) {
+		sizes[vf.Size] = true
+	})
+	if err != nil {
+		return pathList, &DbError{op: "read", err: err}
+	}
 
-	for _, fn := range fns {
-		fullPath := makePath(baseDir, fn)
-		digest, path := EncryptFile(ctx, fn, cacheDir, defaultConfig)
-		pathList = append(pathList, path)
-		kv := LoadBadger(dbDir)
-		vf, err := getVaultFile(kv, digest)
+	unchanged := 0
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return pathList, err
+		}
+		fn := file.path
+		alias := makePath(baseDir, file.rel)
+		fi, err := os.Stat(fn)
 		if err != nil {
-			nvf := VaultFile{
-				Hash:    digest,
-				Aliases: []string{fullPath},
-				Glacier: "",
-				KeyId:   ctx.key(),
-			}
-			insertVaultFile(kv, digest, nvf)
-		} else {
-			for _, p := range vf.Aliases {
-				if p == fullPath {
-					continue
+			return pathList, err
+		}
+		record := newStatRecord(fi)
+		old, found, err := getStatRecord(kv, alias)
+		if err != nil {
+			return pathList, &DbError{op: "read", err: err}
+		}
+		if found && old.unchanged(record) {
+			unchanged++
+			continue
+		}
+
+		// the file is hashed while it is encrypted, unless it may be a
+		// duplicate, which is hashed first so that it is not encrypted again
+		var (
+			digest string
+			vf     VaultFile
+			known  bool
+		)
+		if sizes[record.Size] || (found && old.Size == record.Size) {
+			digest, err = localTreeHash(fn)
+			if err != nil {
+				return pathList, err
+			}
+			vf, err = getVaultFile(kv, digest)
+			known = err == nil
+		}
+		cipherSize := vf.CipherSize
+		encrypted := false
+		if !known || (vf.Locator == "" && !dirExists(makePath(cacheDir, digest))) {
+			var path string
+			digest, path, err = EncryptFile(lc, fn, cacheDir, defaultConfig)
+			if err != nil {
+				return pathList, err
+			}
+			vf, err = getVaultFile(kv, digest)
+			known = err == nil
+			if known && vf.Locator != "" {
+				// a pushed duplicate recorded without its size
+				os.Remove(path)
+				cipherSize = vf.CipherSize
+			} else {
+				pathList = append(pathList, path)
+				if cfi, err := os.Stat(path); err == nil {
+					cipherSize = cfi.Size()
 				}
+				encrypted = true
+			}
+		}
+		if !known {
+			vf = VaultFile{
+				Hash:    digest,
+				Aliases: []string{},
 			}
-			vf.Aliases = append(vf.Aliases, fullPath)
-			insertVaultFile(kv, digest, vf)
 		}
+		if encrypted {
+			vf.KeyIds = lc.recipientIds()
+		}
+		if !containsString(vf.Aliases, alias) {
+			vf.Aliases = append(vf.Aliases, alias)
+		}
+		if vf.Meta == nil {
+			vf.Meta = make(map[string]FileMeta)
+		}
+		meta := newFileMeta(fi)
+		vf.Meta[alias] = meta
+		vf.Size = fi.Size()
+		vf.CipherSize = cipherSize
+		err = insertVaultFile(kv, digest, vf, alias)
+		if err != nil {
+			return pathList, err
+		}
+		sizes[vf.Size] = true
+		err = appendHistory(kv, alias, digest, meta.AddedAt)
+		if err != nil {
+			return pathList, &DbError{op: "write", err: err}
+		}
+		record.Digest = digest
+		err = putStatRecord(kv, alias, record)
+		if err != nil {
+			return pathList, &DbError{op: "write", err: err}
+		}
+	}
+	if unchanged > 0 {
+		progressf(progress, "%d files unchanged\n", unchanged)
 	}
 
-	return pathList
+	return pathList, nil
+}
+
+// Whether the slice contains the string
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
 }
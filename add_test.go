@@ -1,13 +1,15 @@
-package main
+package vault
 
 import (
+	"context"
+	"io/ioutil"
 	"os"
 	"testing"
 )
 
 // newAddContextForTest creates a synthesised add context
 func newPrivLocalContextForTest() LocalContext {
-	v := Vault{"test_files"}
+	v := Vault{directory: "test_files"}
 	keyId := "C21B7817"
 	passphrase := []byte("b88d80170")
 
@@ -18,7 +20,7 @@ func newPrivLocalContextForTest() LocalContext {
 
 // newAddContextForTest creates a synthesised add context
 func newPubLocalContextForTest() LocalContext {
-	v := Vault{"test_files"}
+	v := Vault{directory: "test_files"}
 	keyId := "C21B7817"
 
 	pgp := PublicPgpInfo{keyId: keyId}
@@ -40,7 +42,7 @@ func newDb() {
 	if err != nil && os.IsNotExist(err) {
 		os.MkdirAll(dbDir, 0775)
 	}
-	kv := LoadBadger(dbDir)
+	kv, _ := LoadBadger(dbDir)
 	defer kv.Close()
 }
 
@@ -48,9 +50,145 @@ func TestAddCache(t *testing.T) {
 	newPath()
 	newDb()
 	ctx := newPrivLocalContextForTest()
-	pl := AddCache(&ctx, []string{"test_files/test_file"})
+	pl, _ := AddCache(context.Background(), &ctx, []string{"test_files/test_file"})
 	if len(pl) != 1 || pl[0] != "test_files/.vault/cache/4cd23549dde14b6a1e1cd08501c599c9a86c098b6a96a15290fc78c237923f58" {
 		t.Fatal("Add cache fails")
 	}
 	os.RemoveAll("test_files/.vault")
 }
+
+// Adding the same files again neither reads nor encrypts them
+func TestAddCacheUnchanged(t *testing.T) {
+	newPath()
+	newDb()
+	defer os.RemoveAll("test_files/.vault")
+	ctx := newPrivLocalContextForTest()
+	pl, _ := AddCache(context.Background(), &ctx, []string{"test_files/test_file", "test_files/hello"})
+	if len(pl) != 2 {
+		t.Fatal("Add cache fails")
+	}
+	pl, _ = AddCache(context.Background(), &ctx, []string{"test_files/test_file", "test_files/hello"})
+	if len(pl) != 0 {
+		t.Fatal("unchanged files should be skipped")
+	}
+	// a changed status with the same content is hashed, but not encrypted
+	dbDir := "test_files/.vault/db"
+	kv, _ := LoadBadger(dbDir)
+	putStatRecord(kv, makePath("test_files", "hello"), StatRecord{})
+	kv.Close()
+	pl, _ = AddCache(context.Background(), &ctx, []string{"test_files/hello"})
+	if len(pl) != 0 {
+		t.Fatal("cached content should not be encrypted again")
+	}
+}
+
+// A pushed file is not encrypted again, even if its record has no size
+func TestAddCachePushedDuplicate(t *testing.T) {
+	newPath()
+	newDb()
+	defer os.RemoveAll("test_files/.vault")
+	remoteDir, _ := ioutil.TempDir("", "vault")
+	defer os.RemoveAll(remoteDir)
+	ctx := newPrivLocalContextForTest()
+	AddCache(context.Background(), &ctx, []string{"test_files/hello"})
+	kv, _ := LoadBadger("test_files/.vault/db")
+	backend, _ := NewLocalBackend(remoteDir)
+	alias := makePath("test_files", "hello")
+	vf, _ := getVaultFileByAlias(kv, alias)
+	if err := pushFile(kv, backend, "test_files/.vault/cache", vf.Hash); err != nil {
+		t.Fatal(err.Error())
+	}
+	vf, _ = getVaultFileByAlias(kv, alias)
+	vf.Size = 0
+	insertVaultFile(kv, vf.Hash, vf)
+	putStatRecord(kv, alias, StatRecord{})
+	kv.Close()
+
+	pl, err := AddCache(context.Background(), &ctx, []string{"test_files/hello"})
+	if err != nil || len(pl) != 0 {
+		t.Fatal("pushed content should not be encrypted again: ", pl, err)
+	}
+	if files, _ := ioutil.ReadDir("test_files/.vault/cache"); len(files) != 0 {
+		t.Fatal("no cache file should be left: ", len(files))
+	}
+}
+
+// The size and the file metadata are recorded under the alias
+func TestAddCacheMeta(t *testing.T) {
+	newPath()
+	newDb()
+	defer os.RemoveAll("test_files/.vault")
+	ctx := newPrivLocalContextForTest()
+	AddCache(context.Background(), &ctx, []string{"test_files/hello"})
+	fi, err := os.Stat("test_files/hello")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	kv, _ := LoadBadger("test_files/.vault/db")
+	defer kv.Close()
+	alias := makePath("test_files", "hello")
+	vf, err := getVaultFileByAlias(kv, alias)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if vf.Size != fi.Size() || vf.CipherSize == 0 {
+		t.Fatal("wrong sizes: ", vf.Size, vf.CipherSize)
+	}
+	meta, ok := vf.Meta[alias]
+	if !ok {
+		t.Fatal("no metadata for ", alias)
+	}
+	if meta.Mode != fi.Mode() || !meta.Mtime.Equal(fi.ModTime()) || meta.AddedAt.IsZero() {
+		t.Fatal("wrong metadata")
+	}
+}
+
+// Walk the test files directory, excluding the image
+func TestExpandPaths(t *testing.T) {
+	m, _ := NewMatcher([]string{}, []string{}, []string{"*.png"})
+	files, err := expandPaths(".", []string{"test_files"}, m)
+	if err != nil {
+		t.Fatal("error expanding paths: ", err.Error())
+	}
+	if len(files) != 2 || files[0].path != "test_files/hello" || files[1].rel != "test_files/test_file" {
+		t.Fatal("wrong files: ", files)
+	}
+}
+
+// Files added from a subdirectory or by their absolute path are recorded by
+// their path relative to the vault
+func TestAddFromSubdirectory(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	dir, _ := ioutil.TempDir("", "vault")
+	defer os.RemoveAll(dir)
+	v, err := Init(dir, nil, InitOptions{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	WriteConfig(makePath(dir, CONF_DIR, CONFIG), map[string]string{"signingkey": "C21B7817"})
+	os.MkdirAll(makePath(dir, "docs"), 0755)
+	ioutil.WriteFile(makePath(dir, "docs", "a.txt"), []byte("a"), 0644)
+	ioutil.WriteFile(makePath(dir, "b.txt"), []byte("b"), 0644)
+
+	os.Chdir(makePath(dir, "docs"))
+	v, err = Open(".", testPassphrase)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ctx := context.Background()
+	fns := []string{"a.txt", makePath(v.Dir(), "b.txt")}
+	if _, err = v.Add(ctx, fns, AddOptions{}); err != nil {
+		t.Fatal("error adding: ", err)
+	}
+	// the log resolves the paths as add does
+	for _, fn := range fns {
+		entries, err := v.Log(ctx, fn)
+		if err != nil || len(entries) != 1 {
+			t.Fatal("expect one version of ", fn, ": ", entries, err)
+		}
+	}
+	if _, err = v.Add(ctx, []string{wd}, AddOptions{}); err == nil {
+		t.Fatal("a file outside the vault should not be added")
+	}
+}
@@ -1,16 +1,21 @@
-package main
+package vault
 
 import (
-	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 import (
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/glacier"
 )
@@ -22,24 +27,69 @@ func TreeHash(body io.ReadSeeker) string {
 	return hex.EncodeToString(glacier.ComputeHashes(body).TreeHash)
 }
 
+// treeHasher computes the tree hash of the data written to it, one MiB chunk
+// at a time, so that the data does not need to be kept in memory
+type treeHasher struct {
+	chunk  []byte
+	hashes [][]byte
+}
+
+func newTreeHasher() *treeHasher {
+	return &treeHasher{chunk: make([]byte, 0, MiB)}
+}
+
+func (h *treeHasher) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		size := MiB - len(h.chunk)
+		if size > len(p) {
+			size = len(p)
+		}
+		h.chunk = append(h.chunk, p[:size]...)
+		p = p[size:]
+		if len(h.chunk) == MiB {
+			h.flush()
+		}
+	}
+	return n, nil
+}
+
+// Hash the current chunk
+func (h *treeHasher) flush() {
+	sum := sha256.Sum256(h.chunk)
+	h.hashes = append(h.hashes, sum[:])
+	h.chunk = h.chunk[:0]
+}
+
+// Sum returns the tree hash in hex once all the data is written
+func (h *treeHasher) Sum() string {
+	if len(h.chunk) > 0 {
+		h.flush()
+	}
+	return hex.EncodeToString(combineTreeHashes(h.hashes))
+}
+
 // Return a new Glacier service
+// The sdk does not retry the requests, the callers retry them withRetry
 func NewService(region string) *glacier.Glacier {
 	sess := session.Must(session.NewSession(
 		&aws.Config{
-			Region: aws.String(region),
+			Region:     aws.String(region),
+			MaxRetries: aws.Int(0),
 		}))
 	service := glacier.New(sess)
 	return service
 }
 
 // Upload a file for a given file name
+// The body is streamed from the file, which is read once more to hash it
 // Return error if any occurs
 func UploadFile(fn, vault string, service *glacier.Glacier) (*glacier.ArchiveCreationOutput, error) {
-	fileBytes, err := ioutil.ReadFile(fn)
+	body, err := os.Open(fn)
 	if err != nil {
-		log.Fatal(err.Error())
+		return nil, err
 	}
-	body := io.ReadSeeker(bytes.NewReader(fileBytes))
+	defer body.Close()
 	digest := aws.String(TreeHash(body))
 	// prepare upload input
 	input := &glacier.UploadArchiveInput{
@@ -52,8 +102,400 @@ func UploadFile(fn, vault string, service *glacier.Glacier) (*glacier.ArchiveCre
 	// upload archive
 	resp, err := service.UploadArchive(input)
 	if err != nil {
-		log.Fatal(err.Error())
+		return nil, err
 	}
-	fmt.Println(resp)
 	return resp, nil
 }
+
+const (
+	MiB                   = 1024 * 1024
+	MAX_PART_SIZE         = 4 * 1024 * MiB
+	MAX_SINGLE_UPLOAD     = 4 * 1024 * MiB // larger archives must be uploaded in parts
+	DEFAULT_PART_SIZE     = 64 * MiB
+	DEFAULT_MULTIPART_MIN = 100 * MiB // files larger than this are uploaded in parts
+)
+
+// Whether size is a valid glacier part size, a power of two number of MiB
+// between 1 MiB and 4 GiB
+func validPartSize(size int64) bool {
+	if size < MiB || size > MAX_PART_SIZE || size%MiB != 0 {
+		return false
+	}
+	n := size / MiB
+	return n&(n-1) == 0
+}
+
+// Combine the tree hashes of consecutive parts into the tree hash of the whole
+// Parts must be a power of two number of MiB, so that they align to the tree
+func combineTreeHashes(hashes [][]byte) []byte {
+	for len(hashes) > 1 {
+		next := [][]byte{}
+		for i := 0; i < len(hashes); i += 2 {
+			if i+1 == len(hashes) {
+				next = append(next, hashes[i])
+				continue
+			}
+			sum := sha256.Sum256(append(append([]byte{}, hashes[i]...), hashes[i+1]...))
+			next = append(next, sum[:])
+		}
+		hashes = next
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+	return hashes[0]
+}
+
+// Initiate a multipart upload for the file fn
+// Return the upload id
+func InitiateMultipart(fn, vault string, partSize int64, service *glacier.Glacier) (string, error) {
+	resp, err := service.InitiateMultipartUpload(&glacier.InitiateMultipartUploadInput{
+		AccountId:          aws.String("-"),
+		ArchiveDescription: aws.String(fn),
+		PartSize:           aws.String(strconv.FormatInt(partSize, 10)),
+		VaultName:          aws.String(vault),
+	})
+	if err != nil {
+		return "", err
+	}
+	return *resp.UploadId, nil
+}
+
+// Upload the parts of fn that are not in state.Parts yet
+// The tree hash of each uploaded part is appended to state.Parts, and save is
+// called with the state after every part
+func UploadParts(fn, vault string, state *UploadState, save func(UploadState) error, service *glacier.Glacier) error {
+	file, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	offset := int64(len(state.Parts)) * state.PartSize
+	for ; offset < state.Size; offset += state.PartSize {
+		length := state.PartSize
+		if offset+length > state.Size {
+			length = state.Size - offset
+		}
+		part := io.NewSectionReader(file, offset, length)
+		partHash := hex.EncodeToString(glacier.ComputeHashes(part).TreeHash)
+		_, err = service.UploadMultipartPart(&glacier.UploadMultipartPartInput{
+			AccountId: aws.String("-"),
+			Body:      part,
+			Checksum:  aws.String(partHash),
+			Range:     aws.String(fmt.Sprintf("bytes %d-%d/*", offset, offset+length-1)),
+			UploadId:  aws.String(state.UploadId),
+			VaultName: aws.String(vault),
+		})
+		if err != nil {
+			return err
+		}
+		state.Parts = append(state.Parts, partHash)
+		state.Updated = time.Now()
+		err = save(*state)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Complete the multipart upload once all the parts in state are uploaded
+func CompleteMultipart(vault string, state UploadState, service *glacier.Glacier) (*glacier.ArchiveCreationOutput, error) {
+	hashes := [][]byte{}
+	for _, part := range state.Parts {
+		hash, err := hex.DecodeString(part)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	var resp *glacier.ArchiveCreationOutput
+	err := withRetry(func() error {
+		var err error
+		resp, err = service.CompleteMultipartUpload(&glacier.CompleteMultipartUploadInput{
+			AccountId:   aws.String("-"),
+			ArchiveSize: aws.String(strconv.FormatInt(state.Size, 10)),
+			Checksum:    aws.String(hex.EncodeToString(combineTreeHashes(hashes))),
+			UploadId:    aws.String(state.UploadId),
+			VaultName:   aws.String(vault),
+		})
+		return err
+	})
+	return resp, err
+}
+
+// Abort the multipart upload, glacier drops its uploaded parts
+func AbortMultipart(vault, uploadId string, service *glacier.Glacier) error {
+	return withRetry(func() error {
+		_, err := service.AbortMultipartUpload(&glacier.AbortMultipartUploadInput{
+			AccountId: aws.String("-"),
+			UploadId:  aws.String(uploadId),
+			VaultName: aws.String(vault),
+		})
+		return err
+	})
+}
+
+// List the parts of the multipart upload glacier has received
+// Return the tree hash of every part by the offset it starts at
+// Return an error with code glacier.ErrCodeResourceNotFoundException if
+// glacier no longer knows the upload
+func ListUploadedParts(vault, uploadId string, service *glacier.Glacier) (map[int64]string, error) {
+	parts := make(map[int64]string)
+	input := &glacier.ListPartsInput{
+		AccountId: aws.String("-"),
+		UploadId:  aws.String(uploadId),
+		VaultName: aws.String(vault),
+	}
+	for {
+		var resp *glacier.ListPartsOutput
+		err := withRetry(func() error {
+			var err error
+			resp, err = service.ListParts(input)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range resp.Parts {
+			tokens := strings.SplitN(aws.StringValue(part.RangeInBytes), "-", 2)
+			start, err := strconv.ParseInt(tokens[0], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			parts[start] = aws.StringValue(part.SHA256TreeHash)
+		}
+		if resp.Marker == nil {
+			return parts, nil
+		}
+		input.Marker = resp.Marker
+	}
+}
+
+// Whether the error is glacier not knowing the resource, e.g. a multipart
+// upload it dropped
+func isNotFound(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == glacier.ErrCodeResourceNotFoundException
+}
+
+// List all the in-flight multipart uploads of the vault
+func ListMultipart(vault string, service *glacier.Glacier) ([]*glacier.UploadListElement, error) {
+	uploads := []*glacier.UploadListElement{}
+	input := &glacier.ListMultipartUploadsInput{
+		AccountId: aws.String("-"),
+		VaultName: aws.String(vault),
+	}
+	for {
+		var resp *glacier.ListMultipartUploadsOutput
+		err := withRetry(func() error {
+			var err error
+			resp, err = service.ListMultipartUploads(input)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, resp.UploadsList...)
+		if resp.Marker == nil {
+			return uploads, nil
+		}
+		input.Marker = resp.Marker
+	}
+}
+
+const (
+	ARCHIVE_RETRIEVAL   = "archive-retrieval"
+	INVENTORY_RETRIEVAL = "inventory-retrieval"
+	DEFAULT_TIER        = "Standard"
+)
+
+// Inventory is the JSON output of a glacier inventory retrieval job
+type Inventory struct {
+	VaultARN      string             `json:"VaultARN"`
+	InventoryDate string             `json:"InventoryDate"`
+	ArchiveList   []InventoryArchive `json:"ArchiveList"`
+}
+
+type InventoryArchive struct {
+	ArchiveId          string `json:"ArchiveId"`
+	ArchiveDescription string `json:"ArchiveDescription"`
+	CreationDate       string `json:"CreationDate"`
+	Size               int64  `json:"Size"`
+	SHA256TreeHash     string `json:"SHA256TreeHash"`
+}
+
+type JobFailedError struct {
+	jobId  string
+	status string
+}
+
+func (e *JobFailedError) Error() string {
+	return fmt.Sprintf("Glacier job %s failed: %s", e.jobId, e.status)
+}
+
+type ChecksumMismatchError struct {
+	expected string
+	actual   string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("Checksum mismatch, expected %s but got %s", e.expected, e.actual)
+}
+
+// Initiate an archive retrieval job for a given glacier archive id
+// tier is one of Expedited, Standard and Bulk
+// Return the job id
+func InitiateRetrieval(archiveId, vault, tier string, service *glacier.Glacier) (string, error) {
+	input := &glacier.InitiateJobInput{
+		AccountId: aws.String("-"),
+		JobParameters: &glacier.JobParameters{
+			ArchiveId: aws.String(archiveId),
+			Tier:      aws.String(tier),
+			Type:      aws.String(ARCHIVE_RETRIEVAL),
+		},
+		VaultName: aws.String(vault),
+	}
+	var resp *glacier.InitiateJobOutput
+	err := withRetry(func() error {
+		var err error
+		resp, err = service.InitiateJob(input)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return *resp.JobId, nil
+}
+
+// Delete the archive from the vault
+func DeleteArchive(archiveId, vault string, service *glacier.Glacier) error {
+	input := &glacier.DeleteArchiveInput{
+		AccountId: aws.String("-"),
+		ArchiveId: aws.String(archiveId),
+		VaultName: aws.String(vault),
+	}
+	_, err := service.DeleteArchive(input)
+	return err
+}
+
+// Initiate an inventory retrieval job for the vault
+// Return the job id
+func InitiateInventory(vault string, service *glacier.Glacier) (string, error) {
+	input := &glacier.InitiateJobInput{
+		AccountId: aws.String("-"),
+		JobParameters: &glacier.JobParameters{
+			Format: aws.String("JSON"),
+			Type:   aws.String(INVENTORY_RETRIEVAL),
+		},
+		VaultName: aws.String(vault),
+	}
+	var resp *glacier.InitiateJobOutput
+	err := withRetry(func() error {
+		var err error
+		resp, err = service.InitiateJob(input)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return *resp.JobId, nil
+}
+
+// Download and parse the output of a completed inventory retrieval job
+func GetInventory(jobId, vault string, service *glacier.Glacier) (Inventory, error) {
+	input := &glacier.GetJobOutputInput{
+		AccountId: aws.String("-"),
+		JobId:     aws.String(jobId),
+		VaultName: aws.String(vault),
+	}
+	var resp *glacier.GetJobOutputOutput
+	err := withRetry(func() error {
+		var err error
+		resp, err = service.GetJobOutput(input)
+		return err
+	})
+	if err != nil {
+		return Inventory{}, err
+	}
+	defer resp.Body.Close()
+	inventory := Inventory{}
+	err = json.NewDecoder(resp.Body).Decode(&inventory)
+	if err != nil {
+		return Inventory{}, err
+	}
+	return inventory, nil
+}
+
+// Describe the job every interval until it is completed
+// Return error if the job does not succeed, or the context is done first
+func WaitForJob(ctx context.Context, jobId, vault string, interval time.Duration, service *glacier.Glacier) (*glacier.JobDescription, error) {
+	input := &glacier.DescribeJobInput{
+		AccountId: aws.String("-"),
+		JobId:     aws.String(jobId),
+		VaultName: aws.String(vault),
+	}
+	for {
+		var job *glacier.JobDescription
+		err := withRetry(func() error {
+			var err error
+			job, err = service.DescribeJob(input)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if aws.BoolValue(job.Completed) {
+			if aws.StringValue(job.StatusCode) != glacier.StatusCodeSucceeded {
+				return job, &JobFailedError{jobId: jobId, status: aws.StringValue(job.StatusMessage)}
+			}
+			return job, nil
+		}
+		if err := sleepContext(ctx, interval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Download the output of a completed job into the file ofn
+// The downloaded data is checked against the tree hash returned by glacier
+func DownloadJobOutput(jobId, vault, ofn string, service *glacier.Glacier) error {
+	input := &glacier.GetJobOutputInput{
+		AccountId: aws.String("-"),
+		JobId:     aws.String(jobId),
+		VaultName: aws.String(vault),
+	}
+	var resp *glacier.GetJobOutputOutput
+	err := withRetry(func() error {
+		var err error
+		resp, err = service.GetJobOutput(input)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	writer, err := os.OpenFile(ofn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+	_, err = io.Copy(writer, resp.Body)
+	if err != nil {
+		return err
+	}
+	// glacier only returns the checksum when the whole archive is downloaded
+	if resp.Checksum == nil {
+		return nil
+	}
+	reader, err := os.Open(ofn)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	digest := TreeHash(reader)
+	if digest != *resp.Checksum {
+		return &ChecksumMismatchError{expected: *resp.Checksum, actual: digest}
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/dgraph-io/badger"
+)
+
+const (
+	BACKEND_GLACIER  = "glacier"
+	DEFAULT_INTERVAL = 15 * time.Minute
+)
+
+// Backend stores the encrypted cache objects on a remote storage
+// An object is identified on the backend by its locator
+type Backend interface {
+	// Name of the backend, recorded in the VaultFile
+	Name() string
+	// Target of the backend, e.g. the glacier vault, recorded in the VaultFile
+	Target() string
+	// Put uploads the file and returns its locator
+	Put(fn string) (string, error)
+	// Get downloads the object into the file ofn
+	// Archival backends retrieve the object first, which may take hours, and
+	// stop waiting once the context is done
+	Get(ctx context.Context, locator, ofn string) error
+	// Delete removes the object from the backend
+	Delete(locator string) error
+	// List returns every object stored by the backend, and the time of the
+	// listing, objects stored after it may be absent from the listing
+	List(ctx context.Context) ([]RemoteObject, time.Time, error)
+}
+
+// resumableBackend keeps the progress of its uploads in the kv, so that an
+// interrupted push can resume them
+type resumableBackend interface {
+	Backend
+	resumeWith(kv *badger.KV)
+	// cleanUploads aborts the in-flight uploads that cannot be resumed
+	cleanUploads(cacheDir string) error
+}
+
+// batchBackend requests the retrieval of many archived objects at once, so
+// that they are retrieved in parallel by the remote rather than one by one
+type batchBackend interface {
+	Backend
+	// GetBatch downloads the object of every locator into its file
+	// Return the errors by locator
+	GetBatch(ctx context.Context, files map[string]string) map[string]error
+}
+
+// Download the object of every locator into its file, at once if the backend
+// supports it
+// Return the errors by locator
+func getBatch(ctx context.Context, backend Backend, files map[string]string) map[string]error {
+	if bb, ok := backend.(batchBackend); ok {
+		return bb.GetBatch(ctx, files)
+	}
+	errs := make(map[string]error)
+	for _, locator := range sortedKeys(files) {
+		if err := backend.Get(ctx, locator, files[locator]); err != nil {
+			errs[locator] = err
+		}
+	}
+	return errs
+}
+
+// Wait for the interval, or until the context is done
+// Return the error of the context if it is done first
+func sleepContext(ctx context.Context, interval time.Duration) error {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Return the keys of the map in order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// classedBackend stores its objects in a storage class
+type classedBackend interface {
+	Backend
+	StorageClass() string
+}
+
+// RemoteObject describes an object stored by a backend
+type RemoteObject struct {
+	Locator     string
+	Description string
+	Size        int64
+}
+
+// BackendOptions tune the retrieval of archived objects
+type BackendOptions struct {
+	Tier     string        // retrieval tier, e.g. Expedited, Standard or Bulk
+	Interval time.Duration // interval between two retrieval status checks
+	Progress io.Writer     // progress messages are written to it, nil for none
+}
+
+func DefaultBackendOptions() BackendOptions {
+	return BackendOptions{Tier: DEFAULT_TIER, Interval: DEFAULT_INTERVAL}
+}
+
+type UnknownBackendError struct {
+	name string
+}
+
+func (e *UnknownBackendError) Error() string {
+	return fmt.Sprintf("Unknown backend: %s", e.name)
+}
+
+type BackendMismatchError struct {
+	hash     string
+	expected string
+	actual   string
+}
+
+func (e *BackendMismatchError) Error() string {
+	return fmt.Sprintf("%s is stored on backend %s, but the remote is %s", e.hash, e.expected, e.actual)
+}
+
+// Check that the object with digest hash, stored on the backend name at the
+// target remote, is on the backend
+// Records without a target were stored before it was recorded, and are taken
+// to be on any target of the backend
+// Return BackendMismatchError if it is not
+func checkBackend(backend Backend, hash, name, remote string) error {
+	if name != backend.Name() {
+		return &BackendMismatchError{hash: hash, expected: name, actual: backend.Name()}
+	}
+	if remote != "" && remote != backend.Target() {
+		return &BackendMismatchError{hash: hash, expected: name + "://" + remote,
+			actual: backend.Name() + "://" + backend.Target()}
+	}
+	return nil
+}
+
+// Split the remote config value into the backend name and its target, in
+// the form of name://target
+// A remote without the name is a glacier vault, for backward compatibility
+func parseRemote(remote string) (string, string) {
+	tokens := strings.SplitN(remote, "://", 2)
+	if len(tokens) != 2 {
+		return BACKEND_GLACIER, remote
+	}
+	return tokens[0], tokens[1]
+}
+
+// NewBackend creates the backend selected by the remote config value
+func NewBackend(ctx *AWSContext, opts BackendOptions) (Backend, error) {
+	name, target := parseRemote(ctx.remote())
+	switch name {
+	case BACKEND_GLACIER:
+		if err := setAwsEnv(ctx.baseDirectory()); err != nil {
+			return nil, err
+		}
+		backend, err := NewGlacierBackend(ctx.awsRegion(), target, ctx.multipartMin(), ctx.partSize(), opts)
+		if err != nil {
+			return nil, err
+		}
+		return backend, nil
+	case BACKEND_S3:
+		if err := setAwsEnv(ctx.baseDirectory()); err != nil {
+			return nil, err
+		}
+		backend, err := NewS3Backend(ctx.awsRegion(), ctx.s3Endpoint(), target, ctx.storageClass(), opts)
+		if err != nil {
+			return nil, err
+		}
+		return backend, nil
+	case BACKEND_FILE:
+		backend, err := NewLocalBackend(target)
+		if err != nil {
+			return nil, err
+		}
+		return backend, nil
+	}
+	return nil, &UnknownBackendError{name: name}
+}
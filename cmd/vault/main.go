@@ -0,0 +1,584 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+import (
+	"github.com/archfiery/vault"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// patternList is a flag that can be given several times
+type patternList []string
+
+func (l *patternList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *patternList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func (l *patternList) Get() interface{} {
+	return []string(*l)
+}
+
+// Wrap the flag set with its command name
+type FlagWrap struct {
+	Command string
+	FlagSet *flag.FlagSet
+}
+
+// config command flag set
+func configFlagSet() FlagWrap {
+	command := "config"
+	// by default, these config values work after we set AWS_SDK_LOAD_CONFIG=1
+	flagSet := flag.NewFlagSet(command, flag.ExitOnError)
+	flagSet.String("key", "", "AWS access key ID")
+	flagSet.String("secret", "", "AWS secret access key")
+	flagSet.String("region", "", "AWS service region")
+	flagSet.String("signingkey", "", "Your PGP signing key")
+	flagSet.String("recipients", "", "Comma separated PGP key ids every file is also encrypted to")
+	flagSet.String("remote", "", "Remote storage, glacier://VAULT, s3://BUCKET or file:///DIR")
+	flagSet.String("storageclass", "", "S3 storage class: STANDARD, STANDARD_IA, GLACIER or DEEP_ARCHIVE")
+	flagSet.String("endpoint", "", "S3 compatible endpoint, such as a local MinIO server")
+	flagSet.String("multipartsize", "100", "Files larger than this size in MiB are uploaded to glacier in parts")
+	flagSet.String("partsize", "64", "Glacier part size in MiB, a power of two")
+	flagSet.String("s2kcount", "65536", "Number of times the passphrase of a symmetric vault is hashed, 1024 to 65011712")
+	return FlagWrap{command, flagSet}
+}
+
+// init command flag set
+func initFlagSet() FlagWrap {
+	initSet := flag.NewFlagSet("init", flag.ExitOnError)
+	initSet.String("mode", vault.MODE_PUBKEY, "Encrypt to the PGP keys of the GnuPG keyring, pubkey, or with a passphrase only, symmetric")
+	initSet.Int("s2kcount", 0, "Number of times the passphrase of a symmetric vault is hashed, 1024 to 65011712")
+	return FlagWrap{"init", initSet}
+}
+
+// add command flag set
+func addFlagSet() FlagWrap {
+	command := "add"
+	addSet := flag.NewFlagSet(command, flag.ExitOnError)
+	addSet.Var(&patternList{}, "include", "Only add files matching the pattern when walking a directory, repeatable")
+	addSet.Var(&patternList{}, "exclude", "Skip files matching the pattern when walking a directory, repeatable")
+	return FlagWrap{command, addSet}
+}
+
+// push command flag set
+func pushFlagSet() FlagWrap {
+	command := "push"
+	pushSet := flag.NewFlagSet(command, flag.ExitOnError)
+	pushSet.Int("jobs", 1, "Number of files uploaded at once")
+	return FlagWrap{command, pushSet}
+}
+
+// fetch command flag set
+func fetchFlagSet() FlagWrap {
+	command := "fetch"
+	fetchSet := flag.NewFlagSet(command, flag.ExitOnError)
+	fetchSet.Bool("local", false, "Preserve the local file if it differs from the remote one")
+	fetchSet.Bool("remote", false, "Replace the local file if it differs from the remote one")
+	fetchSet.String("tier", vault.DEFAULT_TIER, "Glacier retrieval tier: Expedited, Standard or Bulk")
+	fetchSet.Duration("interval", vault.DEFAULT_INTERVAL, "Interval between two retrieval job status checks")
+	return FlagWrap{command, fetchSet}
+}
+
+// list command flag set
+func listFlagSet() FlagWrap {
+	command := "list"
+	listSet := flag.NewFlagSet(command, flag.ExitOnError)
+	listSet.String("prefix", "", "Only list files with a path starting with the prefix")
+	listSet.String("state", vault.STATE_ALL, "Only list files in the state: all, pushed, cached or missing")
+	listSet.String("keyid", "", "Only list files encrypted with the PGP key id")
+	return FlagWrap{command, listSet}
+}
+
+// update command flag set
+func updateFlagSet() FlagWrap {
+	command := "update"
+	updateSet := flag.NewFlagSet(command, flag.ExitOnError)
+	updateSet.Duration("interval", vault.DEFAULT_INTERVAL, "Interval between two inventory job status checks")
+	return FlagWrap{command, updateSet}
+}
+
+// status command flag set
+func statusFlagSet() FlagWrap {
+	command := "status"
+	statusSet := flag.NewFlagSet(command, flag.ExitOnError)
+	return FlagWrap{command, statusSet}
+}
+
+// verify command flag set
+func verifyFlagSet() FlagWrap {
+	command := "verify"
+	verifySet := flag.NewFlagSet(command, flag.ExitOnError)
+	verifySet.Bool("remote", false, "Also retrieve and check a sample of the remote objects")
+	verifySet.Int("sample", 1, "Number of remote objects to check")
+	verifySet.String("tier", vault.DEFAULT_TIER, "Glacier retrieval tier: Expedited, Standard or Bulk")
+	verifySet.Duration("interval", vault.DEFAULT_INTERVAL, "Interval between two retrieval job status checks")
+	return FlagWrap{command, verifySet}
+}
+
+// log command flag set
+func logFlagSet() FlagWrap {
+	command := "log"
+	logSet := flag.NewFlagSet(command, flag.ExitOnError)
+	return FlagWrap{command, logSet}
+}
+
+// restore command flag set
+func restoreFlagSet() FlagWrap {
+	command := "restore"
+	restoreSet := flag.NewFlagSet(command, flag.ExitOnError)
+	restoreSet.String("at", "", "Restore the files as they were at this date or time, e.g. 2017-06-01 or 2017-06-01T18:00")
+	restoreSet.Int("batch", 100, "Number of archives retrieved at once")
+	restoreSet.String("tier", vault.DEFAULT_TIER, "Glacier retrieval tier: Expedited, Standard or Bulk")
+	restoreSet.Duration("interval", vault.DEFAULT_INTERVAL, "Interval between two retrieval job status checks")
+	return FlagWrap{command, restoreSet}
+}
+
+// rekey command flag set
+func rekeyFlagSet() FlagWrap {
+	command := "rekey"
+	rekeySet := flag.NewFlagSet(command, flag.ExitOnError)
+	rekeySet.String("prefix", "", "Only rekey files with a path starting with the prefix")
+	rekeySet.String("keyid", "", "Only rekey files encrypted with the PGP key id")
+	rekeySet.Bool("delete", false, "Delete the old archives once the new ones are recorded, otherwise they are left on the remote untracked")
+	rekeySet.Int("batch", 100, "Number of archives retrieved at once")
+	rekeySet.String("tier", vault.DEFAULT_TIER, "Glacier retrieval tier: Expedited, Standard or Bulk")
+	rekeySet.Duration("interval", vault.DEFAULT_INTERVAL, "Interval between two retrieval job status checks")
+	return FlagWrap{command, rekeySet}
+}
+
+// db command flag set
+func dbFlagSet() FlagWrap {
+	command := "db"
+	dbSet := flag.NewFlagSet(command, flag.ExitOnError)
+	return FlagWrap{command, dbSet}
+}
+
+// db migrate command flag set
+func dbMigrateFlagSet() FlagWrap {
+	command := "db migrate"
+	migrateSet := flag.NewFlagSet(command, flag.ExitOnError)
+	migrateSet.Bool("dry-run", false, "Only print the migrations that would run")
+	return FlagWrap{command, migrateSet}
+}
+
+// Get the value of a bool flag by its name
+func boolFlag(fs *flag.FlagSet, name string) bool {
+	return fs.Lookup(name).Value.(flag.Getter).Get().(bool)
+}
+
+// Get the value of a string flag by its name
+func stringFlag(fs *flag.FlagSet, name string) string {
+	return fs.Lookup(name).Value.String()
+}
+
+// Get the value of an int flag by its name
+func intFlag(fs *flag.FlagSet, name string) int {
+	return fs.Lookup(name).Value.(flag.Getter).Get().(int)
+}
+
+// Get the value of a duration flag by its name
+func durationFlag(fs *flag.FlagSet, name string) time.Duration {
+	return fs.Lookup(name).Value.(flag.Getter).Get().(time.Duration)
+}
+
+// Get the value of a pattern list flag by its name
+func patternsFlag(fs *flag.FlagSet, name string) []string {
+	return fs.Lookup(name).Value.(flag.Getter).Get().([]string)
+}
+
+// Get the backend options from the tier and interval flags
+func backendFlags(fs *flag.FlagSet) vault.BackendOptions {
+	return vault.BackendOptions{Tier: stringFlag(fs, "tier"), Interval: durationFlag(fs, "interval"), Progress: os.Stdout}
+}
+
+func getPassphraseFromStdin() ([]byte, error) {
+	// enter passphrase
+	fmt.Print("Please enter passphrase: ")
+	bytePassword, err := terminal.ReadPassword(int(syscall.Stdin))
+	fmt.Println()
+	if err != nil {
+		return nil, fmt.Errorf("error getting password: %w", err)
+	}
+	return bytePassword, nil
+}
+
+// Ask a new passphrase twice on stdin
+func getNewPassphraseFromStdin() ([]byte, error) {
+	passphrase, err := getPassphraseFromStdin()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Print("Please enter the passphrase again: ")
+	again, err := terminal.ReadPassword(int(syscall.Stdin))
+	fmt.Println()
+	if err != nil {
+		return nil, fmt.Errorf("error getting password: %w", err)
+	}
+	if string(again) != string(passphrase) {
+		return nil, vault.NewUsageError("the passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+// Ask a yes or no question on stdin, anything but y or yes means no
+func askYesNo(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	reader := bufio.NewReader(os.Stdin)
+	answer, err := reader.ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func printDefaults(fw []FlagWrap) {
+	for _, f := range fw {
+		fmt.Printf("vault %s\n", f.Command)
+		f.FlagSet.PrintDefaults()
+	}
+}
+
+func main() {
+	// parse flag set
+	initCommand := initFlagSet()
+	configCommand := configFlagSet()
+	addCommand := addFlagSet()
+	pushCommand := pushFlagSet()
+	fetchCommand := fetchFlagSet()
+	listCommand := listFlagSet()
+	updateCommand := updateFlagSet()
+	statusCommand := statusFlagSet()
+	verifyCommand := verifyFlagSet()
+	logCommand := logFlagSet()
+	restoreCommand := restoreFlagSet()
+	rekeyCommand := rekeyFlagSet()
+	dbCommand := dbFlagSet()
+	dbMigrateCommand := dbMigrateFlagSet()
+	flags := []FlagWrap{initCommand, configCommand, addCommand, pushCommand, fetchCommand, listCommand,
+		updateCommand, statusCommand, verifyCommand, logCommand, restoreCommand, rekeyCommand,
+		dbCommand, dbMigrateCommand}
+
+	if len(os.Args) < 2 {
+		fmt.Println("Please specify an action")
+		printDefaults(flags)
+		os.Exit(vault.EXIT_USAGE)
+	}
+
+	commands := make(map[string]*flag.FlagSet)
+	for _, f := range flags {
+		commands[f.Command] = f.FlagSet
+	}
+	fs, ok := commands[os.Args[1]]
+	if !ok {
+		printDefaults(flags)
+		os.Exit(vault.EXIT_USAGE)
+	}
+	fs.Parse(os.Args[2:])
+
+	// an interrupt stops the command between two files, a second one kills it
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		signal.Stop(interrupt)
+		cancel()
+	}()
+
+	// only main decides to exit, with a code depending on the error
+	err := runCommand(ctx, os.Args[1], commands)
+	cancel()
+	if err != nil {
+		log.Print(err.Error())
+		os.Exit(vault.ExitCode(err))
+	}
+}
+
+// Run the command with its parsed flag set
+func runCommand(ctx context.Context, command string, commands map[string]*flag.FlagSet) error {
+	fs := commands[command]
+	if command == "init" {
+		opts := vault.InitOptions{Mode: stringFlag(fs, "mode"), S2KCount: intFlag(fs, "s2kcount")}
+		v, err := vault.Init(".", getNewPassphraseFromStdin, opts)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Initialised a new little vault in %s/%s\n", v.Dir(), vault.CONF_DIR)
+		return nil
+	}
+	v, err := vault.Open(".", getPassphraseFromStdin)
+	if err != nil {
+		return err
+	}
+	switch command {
+	case "config":
+		return v.SetConfig(fs.Args())
+	case "add":
+		opts := vault.AddOptions{Include: patternsFlag(fs, "include"), Exclude: patternsFlag(fs, "exclude"), Progress: os.Stdout}
+		_, err := v.Add(ctx, fs.Args(), opts)
+		return err
+	case "push":
+		return pushFiles(ctx, v, fs)
+	case "fetch":
+		return fetchFiles(ctx, v, fs)
+	case "restore":
+		return restoreFiles(ctx, v, fs)
+	case "rekey":
+		return rekeyFiles(ctx, v, fs)
+	case "list":
+		return listFiles(ctx, v, fs)
+	case "update":
+		return updateInventory(ctx, v, fs)
+	case "status":
+		return printStatus(ctx, v)
+	case "verify":
+		return verifyVault(ctx, v, fs)
+	case "log":
+		return logFile(ctx, v, fs)
+	case "db":
+		return runDbCommand(ctx, v, fs, commands["db migrate"])
+	}
+	return vault.NewUsageError("Unknown command: " + command)
+}
+
+// Whether the error tells that only some of the files failed
+func isFailures(err error) bool {
+	var failures *vault.FailuresError
+	return errors.As(err, &failures)
+}
+
+// pushFiles pushes the cache files with as many workers as the jobs flag, and
+// prints the number of pushed files and the reason of every failure
+func pushFiles(ctx context.Context, v *vault.Vault, fs *flag.FlagSet) error {
+	result, err := v.Push(ctx, vault.PushOptions{Jobs: intFlag(fs, "jobs"), Progress: os.Stdout})
+	if (err == nil && result.Total > 0) || isFailures(err) {
+		fmt.Printf("Pushed %d files, %d failed\n", result.Total-len(result.Failures), len(result.Failures))
+		for _, failure := range result.Failures {
+			fmt.Printf("\t%s: %s\n", failure.Path, failure.Err.Error())
+		}
+	}
+	return err
+}
+
+// fetchFiles fetches every file named in the flag set arguments
+func fetchFiles(ctx context.Context, v *vault.Vault, fs *flag.FlagSet) error {
+	opts := vault.FetchOptions{
+		KeepLocal:  boolFlag(fs, "local"),
+		KeepRemote: boolFlag(fs, "remote"),
+		Backend:    backendFlags(fs),
+		Confirm:    askYesNo,
+		Progress:   os.Stdout,
+	}
+	failures, err := v.Fetch(ctx, fs.Args(), opts)
+	// a single file fails with its own error, and its own exit code
+	if len(fs.Args()) == 1 && len(failures) == 1 {
+		return fmt.Errorf("Fail to fetch %s: %w", failures[0].Path, failures[0].Err)
+	}
+	for _, failure := range failures {
+		fmt.Printf("Fail to fetch %s: %s\n", failure.Path, failure.Err.Error())
+	}
+	return err
+}
+
+// restoreFiles restores the prefix into the target directory, both named in
+// the flag set arguments
+func restoreFiles(ctx context.Context, v *vault.Vault, fs *flag.FlagSet) error {
+	if len(fs.Args()) != 2 {
+		return vault.NewUsageError("Please specify a prefix and a target directory")
+	}
+	opts := vault.RestoreOptions{Batch: intFlag(fs, "batch"), Backend: backendFlags(fs), Progress: os.Stdout}
+	if value := stringFlag(fs, "at"); value != "" {
+		var ok bool
+		opts.At, ok = vault.ParseVersionDate(value)
+		if !ok {
+			return vault.NewUsageError("invalid time: " + value)
+		}
+	}
+	failures, err := v.Restore(ctx, fs.Arg(0), fs.Arg(1), opts)
+	for _, failure := range failures {
+		fmt.Printf("Fail to restore %s: %s\n", failure.Path, failure.Err.Error())
+	}
+	return err
+}
+
+// rekeyFiles re-encrypts the files selected by the flag set to the current
+// recipients, and prints the number of rekeyed files and every failure
+func rekeyFiles(ctx context.Context, v *vault.Vault, fs *flag.FlagSet) error {
+	opts := vault.RekeyOptions{
+		Prefix:   stringFlag(fs, "prefix"),
+		KeyId:    stringFlag(fs, "keyid"),
+		Delete:   boolFlag(fs, "delete"),
+		Batch:    intFlag(fs, "batch"),
+		Backend:  backendFlags(fs),
+		Progress: os.Stdout,
+	}
+	result, err := v.Rekey(ctx, opts)
+	if err == nil || isFailures(err) {
+		fmt.Printf("Rekeyed %d files, %d already encrypted to the recipients, %d failed\n",
+			result.Rekeyed, result.Skipped, len(result.Failures))
+		for _, failure := range result.Failures {
+			fmt.Printf("\t%s: %s\n", failure.Path, failure.Err.Error())
+		}
+	}
+	return err
+}
+
+// listFiles prints every VaultFile record selected by the flag set
+func listFiles(ctx context.Context, v *vault.Vault, fs *flag.FlagSet) error {
+	opts := vault.ListOptions{
+		Prefix: stringFlag(fs, "prefix"),
+		State:  stringFlag(fs, "state"),
+		KeyId:  stringFlag(fs, "keyid"),
+	}
+	files, err := v.List(ctx, opts)
+	if err != nil {
+		return err
+	}
+	for _, vf := range files {
+		fmt.Printf("%s\t%s\t%s\n", vf.Hash, vf.State(), strings.Join(vf.KeyIds, ","))
+		for _, alias := range vf.Aliases {
+			fmt.Printf("\t%s\n", strings.TrimPrefix(alias, v.Dir()+"/"))
+		}
+	}
+	return nil
+}
+
+// updateInventory updates the data store from the remote listing, and prints
+// the records that changed and the unknown objects
+func updateInventory(ctx context.Context, v *vault.Vault, fs *flag.FlagSet) error {
+	opts := vault.DefaultBackendOptions()
+	opts.Interval = durationFlag(fs, "interval")
+	opts.Progress = os.Stdout
+	result, err := v.Update(ctx, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Remote %s has %d objects\n", result.Remote, result.Objects)
+	for _, vf := range result.Updated {
+		fmt.Printf("%s\t%s\t%s\n", vf.Hash, vf.State(), vf.Locator)
+	}
+	for _, object := range result.Unknown {
+		fmt.Printf("unknown object\t%s\t%d bytes\t%s\n", object.Locator, object.Size, object.Description)
+	}
+	return nil
+}
+
+// statusSections are printed in this order, with their titles
+var statusSections = []struct {
+	status string
+	title  string
+}{
+	{vault.STATUS_UNTRACKED, "Files never added"},
+	{vault.STATUS_MODIFIED, "Files modified since they were added"},
+	{vault.STATUS_DELETED, "Files deleted since they were added"},
+	{vault.STATE_CACHED, "Files added but not pushed"},
+	{vault.STATE_MISSING, "Files pushed but missing from the remote"},
+	{vault.STATE_PUSHED, "Files pushed"},
+}
+
+// printStatus prints the status of the files under the vault directory
+func printStatus(ctx context.Context, v *vault.Vault) error {
+	report, err := v.Status(ctx)
+	if err != nil {
+		return err
+	}
+	for _, section := range statusSections {
+		paths := report[section.status]
+		if len(paths) == 0 {
+			continue
+		}
+		fmt.Printf("%s:\n", section.title)
+		for _, path := range paths {
+			fmt.Printf("\t%s\n", path)
+		}
+	}
+	return nil
+}
+
+// verifyVault audits the vault and prints the problems found
+func verifyVault(ctx context.Context, v *vault.Vault, fs *flag.FlagSet) error {
+	opts := vault.VerifyOptions{
+		Remote:   boolFlag(fs, "remote"),
+		Sample:   intFlag(fs, "sample"),
+		Backend:  backendFlags(fs),
+		Progress: os.Stdout,
+	}
+	problems, err := v.Verify(ctx, opts)
+	if err == nil {
+		fmt.Println("No problem found")
+		return nil
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%d problems found\n", len(problems))
+		for _, problem := range problems {
+			fmt.Printf("\t%s: %s\n", problem.Digest, problem.Reason)
+		}
+	}
+	return err
+}
+
+// logFile prints the versions of the file named in the flag set arguments
+func logFile(ctx context.Context, v *vault.Vault, fs *flag.FlagSet) error {
+	if len(fs.Args()) != 1 {
+		return vault.NewUsageError("Please specify a file")
+	}
+	entries, err := v.Log(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	for i, entry := range entries {
+		fmt.Printf("%d\t%s\t%s\t%s\n", i+1, entry.Time.Format(time.RFC3339), entry.Digest, entry.State)
+	}
+	return nil
+}
+
+// runDbCommand runs the db subcommand named in the flag set arguments
+// The flag set of db migrate parses the arguments of the migrate subcommand
+func runDbCommand(ctx context.Context, v *vault.Vault, fs, migrateFs *flag.FlagSet) error {
+	if len(fs.Args()) == 0 {
+		return vault.NewUsageError("Please specify a db command: reindex or migrate")
+	}
+	switch fs.Arg(0) {
+	case "reindex":
+		n, err := v.Reindex(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d aliases indexed\n", n)
+	case "migrate":
+		migrateFs.Parse(fs.Args()[1:])
+		dryRun := boolFlag(migrateFs, "dry-run")
+		n, err := v.Migrate(ctx, dryRun, func(version int, description string, changes int) {
+			fmt.Printf("Schema version %d: %s, %d records changed\n", version, description, changes)
+		})
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			fmt.Printf("The vault db is up to date at schema version %d\n", vault.SCHEMA_VERSION)
+		} else if dryRun {
+			fmt.Printf("%d migrations to run, nothing written\n", n)
+		}
+	default:
+		return vault.NewUsageError("Unknown db command: " + fs.Arg(0))
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package vault
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	CONF_DIR = ".vault"
+	CRED     = "credentials"
+	CONFIG   = "config"
+	CACHE    = "cache"
+	DB       = "db"
+	TMP      = "tmp"
+)
+
+// join strings into a path with delim /
+func makePath(args ...string) string {
+	return strings.Join(args, "/")
+}
+
+// Create an empty file to write with file permission 0664
+func createEmptyFile(fn string) (*os.File, error) {
+	return os.OpenFile(fn, os.O_WRONLY|os.O_RDONLY|os.O_CREATE, 0664)
+}
+
+// Create an empty directory with file permission 0755
+func createEmptyDir(dir string) {
+	_, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		os.Mkdir(dir, 0755)
+	}
+}
+
+// Determines if the path exists or not
+func dirExists(path string) bool {
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false
+	}
+	return true
+}
+
+// Init initialises a new vault in dir with a default config folder
+// A vault may be nested in another one, but dir must not be a vault already
+// f asks the passphrase of the signing key, as for Open, or the passphrase of
+// a symmetric vault, which is asked once here and must not be empty
+func Init(dir string, f PassphraseFunc, opts InitOptions) (*Vault, error) {
+	wd, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	path := makePath(wd, CONF_DIR)
+	if dirExists(path) {
+		return nil, &UsageError{msg: "Vault config already exists for " + wd}
+	}
+	if opts.Mode == "" {
+		opts.Mode = MODE_PUBKEY
+	}
+	if opts.Mode != MODE_PUBKEY && opts.Mode != MODE_SYMMETRIC {
+		return nil, &UsageError{msg: "unknown vault mode " + opts.Mode}
+	}
+	if opts.S2KCount != 0 {
+		if _, err := parseS2KCount(strconv.Itoa(opts.S2KCount)); err != nil {
+			return nil, err
+		}
+	}
+	v := &Vault{directory: wd, passphrase: f}
+	mode := vaultMode{Mode: opts.Mode}
+	if opts.Mode == MODE_SYMMETRIC {
+		passphrase, err := v.askPassphrase()
+		if err != nil {
+			return nil, err
+		}
+		if len(passphrase) == 0 {
+			return nil, &UsageError{msg: "a symmetric vault needs a passphrase"}
+		}
+		s2kCount := opts.S2KCount
+		if s2kCount == 0 {
+			s2kCount = DEFAULT_S2K_COUNT
+		}
+		mode.Check, err = newPassphraseCheck(passphrase, s2kCount)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = os.Mkdir(path, 0775)
+	if err != nil {
+		return nil, err
+	}
+	// create config file
+	conf := makePath(path, CONFIG)
+	confFile, err := createEmptyFile(conf)
+	if err != nil {
+		return nil, err
+	}
+	confFile.Close()
+	if opts.S2KCount != 0 {
+		err = WriteConfig(conf, map[string]string{"s2kcount": strconv.Itoa(opts.S2KCount)})
+		if err != nil {
+			return nil, err
+		}
+	}
+	// create a credential file
+	cred := makePath(path, CRED)
+	credFile, err := createEmptyFile(cred)
+	if err != nil {
+		return nil, err
+	}
+	credFile.Close()
+	// initialise embedded database
+	db := makePath(path, DB)
+	createEmptyDir(db)
+	kv, err := LoadBadger(db)
+	if err != nil {
+		return nil, err
+	}
+	defer kv.Close()
+	err = putVaultMode(kv, mode)
+	if err != nil {
+		return nil, err
+	}
+	// create an empty cache dir
+	cache := makePath(path, CACHE)
+	createEmptyDir(cache)
+	// create an empty dir for downloads
+	tmp := makePath(path, TMP)
+	createEmptyDir(tmp)
+	return v, nil
+}
+
+// Open a file
+func OpenFile(fn string) (*os.File, error) {
+	file, err := os.Open(fn)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open file %s: %w", fn, err)
+	}
+	return file, nil
+}
+
+// Use simplified config key name
+func isCredConfig(key string) bool {
+	//return key == "aws_access_key_id" || key == "aws_secret_access_key"
+	return key == "key" || key == "secret"
+}
+
+// Read config path and return as a key value map
+func ReadConfig(path string) (map[string]string, error) {
+	configs := make(map[string]string)
+	file, err := OpenFile(path)
+	if err != nil {
+		return nil, &ConfigError{key: "file", value: err.Error()}
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("error on reading %s: %w", path, err)
+		}
+		tokens := strings.Split(line, "=")
+		if len(tokens) != 2 {
+			continue
+		}
+		key, value := tokens[0], strings.TrimSuffix(tokens[1], "\n")
+		configs[key] = value
+	}
+	return configs, nil
+}
+
+// Writes the configuration map back to the file
+func WriteConfig(path string, configs map[string]string) error {
+	file, err := createEmptyFile(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	for k, v := range configs {
+		line := k + "=" + v + "\n"
+		_, err = file.WriteString(line)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetConfig updates the old configuration with the KEY=VALUE pairs
+// It is the minimal implementation as it removes all the comments from the
+// configuration as well
+// TOML will probably be more suitable in the future
+func (v *Vault) SetConfig(pairs []string) error {
+	vaultDirPath := v.baseDirectory()
+	// update the config data
+	confPath := makePath(vaultDirPath, CONF_DIR, CONFIG)
+	conf, err := ReadConfig(confPath)
+	if err != nil {
+		return err
+	}
+	// update the cred data
+	credPath := makePath(vaultDirPath, CONF_DIR, CRED)
+	cred, err := ReadConfig(credPath)
+	if err != nil {
+		return err
+	}
+
+	// update or insert key value map
+	for _, pair := range pairs {
+		tokens := strings.Split(pair, "=")
+		if len(tokens) != 2 {
+			continue
+		}
+		// some conversions happens over here
+		key, val := tokens[0], tokens[1]
+		if isCredConfig(key) {
+			switch key {
+			case "key":
+				key = "aws_access_key_id"
+			case "secret":
+				key = "aws_secret_access_key"
+			}
+			cred[key] = val
+		} else {
+			conf[key] = val
+		}
+	}
+	// delete old config file
+	// TODO (archfiery) when the amount of config is not huge, we do this
+	// rewrite
+	os.Remove(confPath)
+	os.Remove(credPath)
+
+	// create a new one with updated conf
+	err = WriteConfig(confPath, conf)
+	if err != nil {
+		return err
+	}
+	return WriteConfig(credPath, cred)
+}
+
+// set aws environment variables
+func setAwsEnv(vaultDir string) error {
+	credPath := makePath(vaultDir, CONF_DIR, CRED)
+	credMap, err := ReadConfig(credPath)
+	if err != nil {
+		return err
+	}
+	key := credMap["aws_access_key_id"]
+	sec := credMap["aws_secret_access_key"]
+
+	configPath := makePath(vaultDir, CONF_DIR, CONFIG)
+	configMap, err := ReadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	region := configMap["region"]
+
+	os.Setenv("AWS_DEFAULT_REGION", region)
+	os.Setenv("AWS_ACCESS_KEY_ID", key)
+	os.Setenv("AWS_SECRET_ACCESS_KEY", sec)
+	return nil
+}
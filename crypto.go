@@ -1,78 +1,90 @@
-package main
+package vault
 
 import (
-	"bytes"
 	"fmt"
 	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/errors"
 	"golang.org/x/crypto/openpgp/packet"
-	"golang.org/x/crypto/ssh/terminal"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/user"
 	"strconv"
 	"strings"
-	"syscall"
 )
 
 type getDirFn func() string
 
-func getHomeDir() string {
+func getHomeDir() (string, error) {
 	currentUser, err := user.Current()
 	if err != nil {
-		log.Fatal("error getting current user")
+		return "", fmt.Errorf("error getting current user: %w", err)
 	}
-	return currentUser.HomeDir
+	return currentUser.HomeDir, nil
 }
 
-func getPubKeyringDir() string {
-	return fmt.Sprintf("%s/.gnupg/pubring.gpg", getHomeDir())
-}
-
-func getPrivKeyringDir() string {
-	return fmt.Sprintf("%s/.gnupg/secring.gpg", getHomeDir())
+func getPubKeyringDir() (string, error) {
+	home, err := getHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/.gnupg/pubring.gpg", home), nil
 }
 
-func getPassphraseFromStdin() []byte {
-	// enter passphrase
-	fmt.Print("Please enter passphrase: ")
-	bytePassword, err := terminal.ReadPassword(int(syscall.Stdin))
-	fmt.Println()
+func getPrivKeyringDir() (string, error) {
+	home, err := getHomeDir()
 	if err != nil {
-		log.Fatal("error getting password")
+		return "", err
 	}
-	return bytePassword
+	return fmt.Sprintf("%s/.gnupg/secring.gpg", home), nil
 }
 
-func getEntityList(fn string) openpgp.EntityList {
+// Read the keyring, return KeyringMissingError if it cannot be read
+func getEntityList(fn string) (openpgp.EntityList, error) {
 	f, err := os.Open(fn)
-	defer f.Close()
 	if err != nil {
-		log.Fatal("error opening key ring file")
+		return nil, &KeyringMissingError{path: fn, err: err}
 	}
+	defer f.Close()
 	entityList, err := openpgp.ReadKeyRing(f)
 	if err != nil {
-		log.Fatal("error reading key ring")
+		return nil, &KeyringMissingError{path: fn, err: err}
 	}
-	return entityList
+	return entityList, nil
+}
+
+// Read the private keyring
+func getPrivEntityList() (openpgp.EntityList, error) {
+	fn, err := getPrivKeyringDir()
+	if err != nil {
+		return nil, err
+	}
+	return getEntityList(fn)
 }
 
 // convert hex string to uint64
-func string2uint64(s string) uint64 {
+func string2uint64(s string) (uint64, error) {
 	num, err := strconv.ParseUint(s, 16, 64)
 	if err != nil {
-		log.Fatal("error converting uint64")
+		return 0, &KeyNotFoundError{keyId: s}
 	}
-
-	return num
+	return num, nil
 }
 
-func getKeysById(s string) []openpgp.Key {
-	id := string2uint64(s)
-	fn := getPubKeyringDir()
-	el := getEntityList(fn)
-	return el.KeysById(id)
+func getKeysById(s string) ([]openpgp.Key, error) {
+	id, err := string2uint64(s)
+	if err != nil {
+		return nil, err
+	}
+	fn, err := getPubKeyringDir()
+	if err != nil {
+		return nil, err
+	}
+	el, err := getEntityList(fn)
+	if err != nil {
+		return nil, err
+	}
+	return el.KeysById(id), nil
 }
 
 // get the second half of the key id string
@@ -88,18 +100,28 @@ func compareString(a, b string) bool {
 	return strings.ToUpper(a) == strings.ToUpper(b)
 }
 
-func getEntityById(fn, keyId string) *openpgp.Entity {
-	entityList := getEntityList(fn)
-	for _, entity := range entityList {
-		identities := entity.Identities
-		for _, identity := range identities {
-			id := getKeyId(*identity.SelfSignature.IssuerKeyId)
-			if compareString(id, keyId) || compareString(id[8:], keyId) {
-				return entity
-			}
+// Whether the key ids have the key id, ignoring the case
+func containsKeyId(keyIds []string, keyId string) bool {
+	for _, id := range keyIds {
+		if compareString(id, keyId) {
+			return true
 		}
 	}
-	return nil
+	return false
+}
+
+// Find the entity of the key id in the keyring
+// Return KeyNotFoundError if the keyring has no such key
+func getEntityById(fn, keyId string) (*openpgp.Entity, error) {
+	entityList, err := getEntityList(fn)
+	if err != nil {
+		return nil, err
+	}
+	entity := filterEntityById(keyId, &entityList)
+	if entity == nil {
+		return nil, &KeyNotFoundError{keyId: keyId}
+	}
+	return entity, nil
 }
 
 func filterEntityById(keyId string, entityList *openpgp.EntityList) *openpgp.Entity {
@@ -127,101 +149,170 @@ func printEntity(entity *openpgp.Entity) string {
 	return ""
 }
 
+// encryptFunc starts an openpgp message written to the ciphertext writer
+type encryptFunc func(ciphertext io.Writer) (io.WriteCloser, error)
+
 // Encrypts the file and returns its sha256 hash value of the original file
+// The file is streamed through the encryption, and the tree hash is computed
+// on the way, so the memory use does not depend on the file size
 // fn: file name to encrypt
 // ofp: output file path
-// entity: openpgp entity
-// signed: if true, then it also signs the encryption with the same key
-// config: encryption config
-func encryptFileHelper(fn, ofp string, entity *openpgp.Entity, signed bool, config *packet.Config) (string, string) {
-	entityList := []*openpgp.Entity{entity}
-
-	br, err := ioutil.ReadFile(fn)
+// encrypt: starts the message, to public keys or with a passphrase
+func encryptFileHelper(fn, ofp string, encrypt encryptFunc) (string, string, error) {
+	reader, err := os.Open(fn)
 	if err != nil {
-		log.Fatal("error reading input file during encryption")
+		return "", "", err
 	}
-	// obtain the hash value as file name
-	body := io.ReadSeeker(bytes.NewReader(br))
-	digest := TreeHash(body)
+	defer reader.Close()
 
-	writeFn := makePath(ofp, digest)
-	writer, err := os.OpenFile(writeFn, os.O_WRONLY|os.O_CREATE, 0664)
+	// the digest is only known at the end, so write to a partial file first,
+	// closed and synced before it is renamed
+	writer, err := ioutil.TempFile(ofp, "*"+PARTIAL_EXT)
 	if err != nil {
-		log.Fatal("error opening writer file")
+		return "", "", err
 	}
-	defer writer.Close()
-
-	var signer *openpgp.Entity
-	if signed {
-		signer = entity
+	partial := writer.Name()
+
+	hasher := newTreeHasher()
+	wc, err := encrypt(writer)
+	if err == nil {
+		_, err = io.Copy(wc, io.TeeReader(reader, hasher))
+		if cerr := wc.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("error encrypting %s: %w", fn, err)
 	} else {
-		signer = nil
+		err = writer.Sync()
+	}
+	if cerr := writer.Close(); err == nil {
+		err = cerr
 	}
-	wc, err := openpgp.Encrypt(writer, entityList, signer, nil, config)
 	if err != nil {
-		log.Fatal("error getting writer closer during encryption")
+		os.Remove(partial)
+		return "", "", err
 	}
-	defer wc.Close()
 
-	_, err = wc.Write(br)
+	// obtain the hash value as file name
+	digest := hasher.Sum()
+	writeFn := makePath(ofp, digest)
+	err = os.Rename(partial, writeFn)
 	if err != nil {
-		log.Fatal("error writing input")
+		os.Remove(partial)
+		return "", "", err
 	}
 
-	return digest, writeFn
+	return digest, writeFn, nil
+}
+
+// Find the entities of the key ids in the public keyring
+// The signer, if there is one, stands for its own key id
+// Return KeyNotFoundError if the keyring has no key for one of them
+func getRecipientEntities(keyIds []string, signer *openpgp.Entity) ([]*openpgp.Entity, error) {
+	entities := []*openpgp.Entity{}
+	var entityList openpgp.EntityList
+	for _, keyId := range keyIds {
+		if signer != nil && filterEntityById(keyId, &openpgp.EntityList{signer}) != nil {
+			entities = append(entities, signer)
+			continue
+		}
+		if entityList == nil {
+			keyring, err := getPubKeyringDir()
+			if err != nil {
+				return nil, err
+			}
+			entityList, err = getEntityList(keyring)
+			if err != nil {
+				return nil, err
+			}
+		}
+		entity := filterEntityById(keyId, &entityList)
+		if entity == nil {
+			return nil, &KeyNotFoundError{keyId: keyId}
+		}
+		entities = append(entities, entity)
+	}
+	return entities, nil
 }
 
-func EncryptFile(ctx *LocalContext, fn, ofp string, config *packet.Config) (string, string) {
-	var entity *openpgp.Entity
-	signed := false
+// EncryptFile encrypts the file to the signing key and the recipients of the
+// context, and signs it when the context carries the passphrase
+// A symmetric vault encrypts it with the passphrase instead, without reading
+// the keyring
+func EncryptFile(ctx *LocalContext, fn, ofp string, config *packet.Config) (string, string, error) {
+	if ctx.symmetric() {
+		symConfig := packet.Config{}
+		if config != nil {
+			symConfig = *config
+		}
+		symConfig.S2KCount = ctx.s2kCount
+		return encryptFileHelper(fn, ofp, func(ciphertext io.Writer) (io.WriteCloser, error) {
+			return openpgp.SymmetricallyEncrypt(ciphertext, ctx.pass(), nil, &symConfig)
+		})
+	}
+	var signer *openpgp.Entity
 	if _, ok := (ctx.pgp).(PrivatePgpInfo); ok {
 		// get private entity
-		entity = getEntityById(getPrivKeyringDir(), ctx.key())
-		if entity == nil {
-			log.Fatal("key not found")
+		keyring, err := getPrivKeyringDir()
+		if err != nil {
+			return "", "", err
+		}
+		signer, err = getEntityById(keyring, ctx.key())
+		if err != nil {
+			return "", "", err
 		}
 		passphrase := ctx.pass()
-		err := entity.PrivateKey.Decrypt(passphrase)
+		err = signer.PrivateKey.Decrypt(passphrase)
 		if err != nil {
-			log.Fatal("error decrypting private key")
+			return "", "", &WrongPassphraseError{keyId: ctx.key()}
 		}
-		signed = true
-	} else {
-		entity = getEntityById(getPubKeyringDir(), ctx.key())
 	}
-	return encryptFileHelper(fn, ofp, entity, signed, config)
+	recipients, err := getRecipientEntities(ctx.recipientIds(), signer)
+	if err != nil {
+		return "", "", err
+	}
+	return encryptFileHelper(fn, ofp, func(ciphertext io.Writer) (io.WriteCloser, error) {
+		return openpgp.Encrypt(ciphertext, recipients, signer, nil, config)
+	})
 }
 
 // encrypt, and sign a file and output it to a new file with extension pgp
-func signHelper(fn, keyId string, passphrase []byte) {
-	entityList := getEntityList(getPrivKeyringDir())
-	entity := filterEntityById(keyId, &entityList)
+func signHelper(fn, keyId string, passphrase []byte) error {
+	keyring, err := getPrivKeyringDir()
+	if err != nil {
+		return err
+	}
+	entity, err := getEntityById(keyring, keyId)
+	if err != nil {
+		return err
+	}
 	// key
-	err := entity.PrivateKey.Decrypt(passphrase)
+	err = entity.PrivateKey.Decrypt(passphrase)
 	if err != nil {
-		log.Fatal("error decrypt private key by using passphrase")
+		return &WrongPassphraseError{keyId: keyId}
 	}
 	file, err := os.Open(fn)
 	if err != nil {
-		log.Fatal("error opening input file")
+		return err
 	}
 	defer file.Close()
 	writer, err := os.OpenFile(fn+".signed", os.O_WRONLY|os.O_CREATE, 0664)
 	if err != nil {
-		log.Fatal("error creating writer")
+		return err
 	}
 	defer writer.Close()
-	defer file.Close()
-	err = openpgp.ArmoredDetachSign(file, entity, file, nil)
-	if err != nil {
-		log.Fatal("error signing")
-	}
+	return openpgp.ArmoredDetachSign(file, entity, file, nil)
 }
 
-func sign(fn, keyId string) {
-	// get passphrase
-	passphrase := getPassphraseFromStdin()
-	signHelper(fn, keyId, passphrase)
+// Convert the errors of reading a message
+// The prompt and openpgp report a key that cannot be decrypted as
+// ErrKeyIncorrect
+func readMessageError(err error) error {
+	if err == errors.ErrKeyIncorrect {
+		return &WrongPassphraseError{}
+	}
+	return err
 }
 
 type PgpMismatchError struct{}
@@ -230,32 +321,146 @@ func (e *PgpMismatchError) Error() string {
 	return "PublicPgpInfo cannot be used to generate prompt"
 }
 
-func DecryptFile(fn string, config *packet.Config, prompt openpgp.PromptFunction) string {
-	input, err := os.Open(fn)
-	defer input.Close()
+// Returns a prompt function that decrypts the private keys with the passphrase
+// of the context, or gives the passphrase of a symmetric vault
+// The keys that do not accept the passphrase are left encrypted, the prompt
+// fails only if none accepts it
+// Return PgpMismatchError if the context carries no passphrase
+func promptFromContext(ctx *LocalContext) (openpgp.PromptFunction, error) {
+	if _, ok := (ctx.pgp).(PrivatePgpInfo); !ok {
+		return nil, &PgpMismatchError{}
+	}
+	return func(keys []openpgp.Key, symm bool) ([]byte, error) {
+		if symm && ctx.symmetric() {
+			return ctx.pass(), nil
+		}
+		if symm || len(keys) == 0 {
+			return nil, errors.ErrKeyIncorrect
+		}
+		decrypted := 0
+		for _, key := range keys {
+			if key.PrivateKey.Decrypt(ctx.pass()) == nil {
+				decrypted++
+			}
+		}
+		if decrypted == 0 {
+			return nil, errors.ErrKeyIncorrect
+		}
+		return nil, nil
+	}, nil
+}
+
+// privKeyring reads the private keyring the first time a key is looked up, so
+// that the messages encrypted with a passphrase are read without a keyring
+type privKeyring struct {
+	entities openpgp.EntityList
+	err      error
+	read     bool
+}
+
+func (k *privKeyring) load() openpgp.EntityList {
+	if !k.read {
+		k.entities, k.err = getPrivEntityList()
+		k.read = true
+	}
+	return k.entities
+}
+
+func (k *privKeyring) KeysById(id uint64) []openpgp.Key {
+	return k.load().KeysById(id)
+}
+
+func (k *privKeyring) KeysByIdUsage(id uint64, requiredUsage byte) []openpgp.Key {
+	return k.load().KeysByIdUsage(id, requiredUsage)
+}
+
+func (k *privKeyring) DecryptionKeys() []openpgp.Key {
+	return k.load().DecryptionKeys()
+}
+
+// Read the openpgp message with the private keyring and the prompt
+// openpgp asks the passphrase of a symmetric message again as long as it is
+// wrong, so the prompt is only asked once for it
+// Return KeyringMissingError if the message needed the keyring and it cannot
+// be read
+func readMessage(input io.Reader, config *packet.Config, prompt openpgp.PromptFunction) (*openpgp.MessageDetails, error) {
+	keyring := &privKeyring{}
+	asked := false
+	once := func(keys []openpgp.Key, symm bool) ([]byte, error) {
+		if symm {
+			if asked {
+				return nil, errors.ErrKeyIncorrect
+			}
+			asked = true
+		}
+		return prompt(keys, symm)
+	}
+	if prompt == nil {
+		once = nil
+	}
+	md, err := openpgp.ReadMessage(input, keyring, once, config)
 	if err != nil {
-		log.Fatal("error opening input file during decrytion")
+		if keyring.err != nil {
+			return nil, keyring.err
+		}
+		return nil, readMessageError(err)
 	}
-	entityList := getEntityList(getPrivKeyringDir())
+	return md, nil
+}
 
-	writeFn := fn + ".decrypt"
-	writer, err := os.OpenFile(writeFn, os.O_WRONLY|os.O_CREATE, 0664)
+// Decrypts the file into a new temporary file in the output directory, and
+// returns its name
+// The output directory must not be the cache, which only holds ciphertexts
+func DecryptFile(fn, ofp string, config *packet.Config, prompt openpgp.PromptFunction) (string, error) {
+	input, err := os.Open(fn)
 	if err != nil {
-		log.Fatal("error opening input file")
+		return "", err
 	}
-	defer writer.Close()
+	defer input.Close()
 
-	md, err := openpgp.ReadMessage(input, entityList, prompt, config)
+	md, err := readMessage(input, config, prompt)
 	if err != nil {
-		log.Fatal("error reading message: ", err.Error())
+		return "", err
 	}
-	byteArray, err := ioutil.ReadAll(md.UnverifiedBody)
-	_, err = writer.Write(byteArray)
+	writer, err := ioutil.TempFile(ofp, "*.decrypt")
 	if err != nil {
-		log.Fatal("error writiting to output file")
+		return "", err
 	}
+	_, err = io.Copy(writer, md.UnverifiedBody)
+	if err == nil {
+		err = writer.Close()
+	} else {
+		writer.Close()
+	}
+	if err != nil {
+		os.Remove(writer.Name())
+		return "", fmt.Errorf("error decrypting %s: %w", fn, err)
+	}
+	return writer.Name(), nil
+}
 
-	return writeFn
+// Decrypts the file and returns the tree hash of the plaintext, without
+// writing the plaintext anywhere
+// If the file is signed, the signature is checked as well
+func DecryptTreeHash(fn string, config *packet.Config, prompt openpgp.PromptFunction) (string, error) {
+	input, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer input.Close()
+	md, err := readMessage(input, config, prompt)
+	if err != nil {
+		return "", err
+	}
+	hasher := newTreeHasher()
+	_, err = io.Copy(hasher, md.UnverifiedBody)
+	if err != nil {
+		return "", err
+	}
+	if md.IsSigned && md.SignatureError != nil {
+		return "", md.SignatureError
+	}
+	return hasher.Sum(), nil
 }
 
 type SigInfo struct {
@@ -263,24 +468,22 @@ type SigInfo struct {
 	SignedBy      *openpgp.Key
 }
 
-func GetSignature(fn string, config *packet.Config, prompt openpgp.PromptFunction) (SigInfo, bool) {
+func GetSignature(fn string, config *packet.Config, prompt openpgp.PromptFunction) (SigInfo, bool, error) {
 	input, err := os.Open(fn)
-	defer input.Close()
 	if err != nil {
-		log.Fatal("error opening input file during decrytion")
+		return SigInfo{}, false, err
 	}
+	defer input.Close()
 
-	entityList := getEntityList(getPrivKeyringDir())
-
-	md, err := openpgp.ReadMessage(input, entityList, prompt, config)
+	md, err := readMessage(input, config, prompt)
 	if err != nil {
-		log.Fatal("error reading message from input file")
+		return SigInfo{}, false, err
 	}
 	if md.IsSigned {
 		return SigInfo{
 			SignedByKeyId: md.SignedByKeyId,
 			SignedBy:      md.SignedBy,
-		}, true
+		}, true, nil
 	}
-	return SigInfo{}, false
+	return SigInfo{}, false, nil
 }
@@ -1,4 +1,4 @@
-package main
+package vault
 
 import (
 	"bytes"
@@ -19,17 +19,27 @@ import (
 func TestPrintEntity(t *testing.T) {
 	keyId := "C21B7817"
 	targetStr := "B2E225E7C21B7817\tb88d80170 test key 01 <b88d80170@gmail.com>"
+	pubring, _ := getPubKeyringDir()
+	secring, _ := getPrivKeyringDir()
 	// public key
-	if entityStr := printEntity(getEntityById(getPubKeyringDir(), keyId)); entityStr != targetStr {
+	entity, err := getEntityById(pubring, keyId)
+	if entityStr := printEntity(entity); err != nil || entityStr != targetStr {
 		t.Fatal(entityStr)
 	}
 	// private key
-	if entityStr := printEntity(getEntityById(getPrivKeyringDir(), keyId)); entityStr != targetStr {
+	entity, err = getEntityById(secring, keyId)
+	if entityStr := printEntity(entity); err != nil || entityStr != targetStr {
 		t.Fatal(entityStr)
 	}
-	// some random key, silently fail
-	if entityStr := printEntity(getEntityById(getPrivKeyringDir(), "some random string")); entityStr != "" {
-		t.Fatal(entityStr)
+	// some random key
+	entity, err = getEntityById(secring, "some random string")
+	if _, ok := err.(*KeyNotFoundError); !ok || printEntity(entity) != "" {
+		t.Fatal("expect key not found error")
+	}
+	// a missing keyring
+	_, err = getEntityById("test_files/no_such_keyring", keyId)
+	if _, ok := err.(*KeyringMissingError); !ok {
+		t.Fatal("expect keyring missing error")
 	}
 }
 
@@ -41,11 +51,14 @@ func promptForKeyC21B7817() openpgp.PromptFunction {
 		if len(keys) == 0 {
 			return nil, errors.ErrKeyIncorrect
 		}
-		entityList := getEntityList(getPrivKeyringDir())
+		entityList, err := getPrivEntityList()
+		if err != nil {
+			return nil, err
+		}
 		entity := filterEntityById("C21B7817", &entityList)
 		passphrase := []byte("b88d80170")
 		// key
-		err := keys[0].PrivateKey.Decrypt(passphrase)
+		err = keys[0].PrivateKey.Decrypt(passphrase)
 		if err != nil {
 			return nil, errors.ErrKeyIncorrect
 		}
@@ -67,15 +80,21 @@ func defaultConfig() *packet.Config {
 func cleanFiles(encryptedFn string) {
 	// clear files
 	os.Remove(encryptedFn)
-	os.Remove(encryptedFn + ".decrypt")
 }
 
 func encryptDecrypt(t *testing.T, ctx *LocalContext, fn string) {
 	config := defaultConfig()
 	ofp := "test_files"
 	prompt := promptForKeyC21B7817()
-	_, encryptedFn := EncryptFile(ctx, fn, ofp, config)
-	decryptedFn := DecryptFile(encryptedFn, config, prompt)
+	_, encryptedFn, err := EncryptFile(ctx, fn, ofp, config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	decryptedFn, err := DecryptFile(encryptedFn, ofp, config, prompt)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Remove(decryptedFn)
 
 	// compare
 	fbOrig, _ := ioutil.ReadFile(fn)
@@ -107,12 +126,34 @@ func TestEncryptDecryptWithoutSign(t *testing.T) {
 	encryptDecrypt(t, &ctx, "test_files/image.png")
 }
 
+// Files are encrypted to the signing key and every other recipient
+func TestEncryptRecipients(t *testing.T) {
+	if keyIds := parseRecipients(" C21B7817, ,B2E225E7"); len(keyIds) != 2 || keyIds[1] != "B2E225E7" {
+		t.Fatal("wrong recipients: ", keyIds)
+	}
+	ctx := newPrivLocalContextForTest()
+	ctx.recipients = []string{"c21b7817"}
+	if keyIds := ctx.recipientIds(); len(keyIds) != 1 {
+		t.Fatal("the signing key should be a recipient once: ", keyIds)
+	}
+	encryptDecrypt(t, &ctx, "test_files/test_file")
+
+	ctx.recipients = []string{"0B1E4A2C"}
+	_, _, err := EncryptFile(&ctx, "test_files/test_file", "test_files", defaultConfig())
+	if _, ok := err.(*KeyNotFoundError); !ok {
+		t.Fatal("expect an unknown recipient to fail: ", err)
+	}
+}
+
 func TestVerifyWithSign(t *testing.T) {
 	encryptVerify := func(t *testing.T, ctx *LocalContext, fn string) {
 		config, ofp, prompt := defaultConfig(), "test_files", promptForKeyC21B7817()
-		_, encryptedFn := EncryptFile(ctx, fn, ofp, config)
-		sig, b := GetSignature(encryptedFn, config, prompt)
-		if !b {
+		_, encryptedFn, err := EncryptFile(ctx, fn, ofp, config)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		sig, b, err := GetSignature(encryptedFn, config, prompt)
+		if err != nil || !b {
 			t.Fatal("It should be signed")
 		}
 		sid := getShortKeyId(sig.SignedByKeyId)
@@ -130,9 +171,12 @@ func TestVerifyWithSign(t *testing.T) {
 func TestVerifyWithoutSign(t *testing.T) {
 	encryptVerify := func(t *testing.T, ctx *LocalContext, fn string) {
 		config, ofp, prompt := defaultConfig(), "test_files", promptForKeyC21B7817()
-		_, encryptedFn := EncryptFile(ctx, fn, ofp, config)
-		_, b := GetSignature(encryptedFn, config, prompt)
-		if b {
+		_, encryptedFn, err := EncryptFile(ctx, fn, ofp, config)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_, b, err := GetSignature(encryptedFn, config, prompt)
+		if err != nil || b {
 			t.Fatal("It should be not signed")
 		}
 		// clean dir
@@ -142,3 +186,77 @@ func TestVerifyWithoutSign(t *testing.T) {
 	encryptVerify(t, &ctx, "test_files/test_file")
 	encryptVerify(t, &ctx, "test_files/image.png")
 }
+
+// Only the complete encrypted file is left in the output directory
+func TestEncryptFilePartial(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "vault")
+	defer os.RemoveAll(dir)
+	failed := func(w io.Writer) (io.WriteCloser, error) {
+		return nil, errors.ErrKeyIncorrect
+	}
+	if _, _, err := encryptFileHelper("test_files/hello", dir, failed); err == nil {
+		t.Fatal("expect the encryption to fail")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatal("the partial file should be removed: ", len(files))
+	}
+
+	ctx := newPrivLocalContextForTest()
+	digest, _, err := EncryptFile(&ctx, "test_files/hello", dir, defaultConfig())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 || files[0].Name() != digest {
+		t.Fatal("expect the encrypted file only: ", files)
+	}
+}
+
+// The prompt decrypts the keys that accept the passphrase, even if another
+// candidate key does not
+func TestPromptFromContext(t *testing.T) {
+	entityList, err := getPrivEntityList()
+	if err != nil {
+		t.Fatal("error reading the keyring: ", err.Error())
+	}
+	entity := filterEntityById("C21B7817", &entityList)
+	// a copy of a key of the keyring with a corrupt checksum never decrypts
+	fn, _ := getPrivKeyringDir()
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	reader := packet.NewOpaqueReader(f)
+	opaque, err := reader.Next()
+	// 5 is the tag of a secret key packet
+	for err == nil && opaque.Tag != 5 {
+		opaque, err = reader.Next()
+	}
+	if err != nil {
+		t.Fatal("error reading the keyring: ", err)
+	}
+	opaque.Contents[len(opaque.Contents)-1] ^= 0xff
+	p, err := opaque.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := p.(*packet.PrivateKey)
+
+	ctx := newPrivLocalContextForTest()
+	prompt, err := promptFromContext(&ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = prompt([]openpgp.Key{{PrivateKey: corrupt}}, false)
+	if err != errors.ErrKeyIncorrect {
+		t.Fatal("expect no key to accept the passphrase: ", err)
+	}
+	_, err = prompt([]openpgp.Key{{PrivateKey: corrupt}, {Entity: entity, PrivateKey: entity.PrivateKey}}, false)
+	if err != nil {
+		t.Fatal("expect the other key to be decrypted: ", err)
+	}
+	if entity.PrivateKey.Encrypted || !corrupt.Encrypted {
+		t.Fatal("expect only the key accepting the passphrase to be decrypted")
+	}
+}
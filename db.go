@@ -1,8 +1,13 @@
-package main
+package vault
 
 import (
-	"encoding/json"
-	"log"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 import (
@@ -10,57 +15,324 @@ import (
 )
 
 type VaultFile struct {
-	Hash    string   `json:"hash"`    // raw hash value computed by glacier SHA256 tree hasher
-	Aliases []string `json:"aliases"` // all file path relevant to the vault config path
-	Glacier string   `json:"glacier"` // glacier id
-	KeyId   string   `json:"keyid"`   // openpgp key id, last 32 bit in hex
+	Hash         string              `json:"hash"`              // raw hash value computed by glacier SHA256 tree hasher
+	Aliases      []string            `json:"aliases"`           // all file path relevant to the vault config path
+	Backend      string              `json:"backend"`           // name of the backend storing the file, empty if only cached
+	Remote       string              `json:"remote,omitempty"`  // target of the backend, e.g. glacier vault, empty on older records
+	Locator      string              `json:"locator"`           // object locator on the backend, e.g. glacier archive id
+	Glacier      string              `json:"glacier,omitempty"` // deprecated glacier id, read into Backend and Locator
+	KeyId        string              `json:"keyid,omitempty"`   // deprecated single key id, read into KeyIds
+	KeyIds       []string            `json:"keyids"`            // openpgp key ids of the recipients, last 32 bit in hex
+	Missing      bool                `json:"missing"`           // locator not found in the last remote listing
+	Size         int64               `json:"size"`              // size of the original file
+	CipherSize   int64               `json:"ciphersize"`        // size of the encrypted cache object
+	StorageClass string              `json:"storageclass"`      // storage class on the backend, if it has any
+	PushedAt     time.Time           `json:"pushedat"`          // time the object was stored on the backend
+	Meta         map[string]FileMeta `json:"meta,omitempty"`    // file metadata of each alias
+}
+
+// FileMeta is the metadata of a file when it was added under an alias
+// Records written before it was introduced have no metadata
+type FileMeta struct {
+	Mode    os.FileMode `json:"mode"`    // permission and mode bits
+	Mtime   time.Time   `json:"mtime"`   // modification time
+	Uid     int         `json:"uid"`     // owner user id, -1 if unknown
+	Gid     int         `json:"gid"`     // owner group id, -1 if unknown
+	Owner   string      `json:"owner"`   // owner user name, empty if unknown
+	AddedAt time.Time   `json:"addedat"` // time the file was added
+}
+
+func newFileMeta(fi os.FileInfo) FileMeta {
+	sys := sysStat(fi)
+	meta := FileMeta{
+		Mode:    fi.Mode(),
+		Mtime:   fi.ModTime(),
+		Uid:     sys.uid,
+		Gid:     sys.gid,
+		AddedAt: time.Now(),
+	}
+	if sys.uid >= 0 {
+		if u, err := user.LookupId(strconv.Itoa(sys.uid)); err == nil {
+			meta.Owner = u.Username
+		}
+	}
+	return meta
+}
+
+// Decode a VaultFile record
+// Records written before backends were introduced only have a glacier id, and
+// the ones written before recipients were introduced a single key id
+func decodeVaultFile(b []byte) (VaultFile, error) {
+	vf := VaultFile{}
+	err := decodeRecord(b, &vf)
+	if err != nil {
+		return VaultFile{}, err
+	}
+	if vf.Locator == "" && vf.Glacier != "" {
+		vf.Backend = BACKEND_GLACIER
+		vf.Locator = vf.Glacier
+		vf.Glacier = ""
+	}
+	if len(vf.KeyIds) == 0 && vf.KeyId != "" {
+		vf.KeyIds = []string{vf.KeyId}
+		vf.KeyId = ""
+	}
+	return vf, nil
+}
+
+// Records other than VaultFile are stored under keys in the form of
+// prefix:name, VaultFile keys are the bare digests
+const (
+	KEY_SEP       = ":"
+	UPLOAD_PREFIX = "upload" + KEY_SEP
+	ALIAS_PREFIX  = "alias" + KEY_SEP
+)
+
+// UploadState is the progress of an in-flight multipart upload, saved after
+// every part so that an interrupted push can resume it
+type UploadState struct {
+	Remote   string    `json:"remote"`   // remote the upload belongs to, e.g. the glacier vault
+	UploadId string    `json:"uploadid"` // multipart upload id
+	PartSize int64     `json:"partsize"` // part size in bytes
+	Size     int64     `json:"size"`     // size of the whole file
+	Parts    []string  `json:"parts"`    // tree hashes of the uploaded parts, in order
+	Updated  time.Time `json:"updated"`  // time of the last uploaded part
 }
 
 // Create or get the badger KV object
-func LoadBadger(path string) *badger.KV {
+// The catalog is migrated to the current schema version first, silently
+func LoadBadger(path string) (*badger.KV, error) {
+	kv, err := openBadger(path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = migrateKV(kv, false, func(m migration, changes int) {})
+	if err != nil {
+		kv.Close()
+		return nil, &DbError{op: "migrate", err: err}
+	}
+	return kv, nil
+}
+
+// Create or get the badger KV object as it is, without migrating it
+func openBadger(path string) (*badger.KV, error) {
 	opt := badger.DefaultOptions
 	opt.Dir = path
 	opt.ValueDir = path
 	kv, err := badger.NewKV(&opt)
 	if err != nil {
-		log.Fatal("Fail to create a new badger KV")
+		return nil, &DbError{op: "open", err: err}
 	}
-	return kv
+	return kv, nil
 }
 
 // Insert new record to kv, override the previous one if exists
-func insertVaultFile(kv *badger.KV, key string, v VaultFile) {
+// The aliases of the record that are not indexed yet, and the added aliases,
+// are indexed to the key in the same batch
+func insertVaultFile(kv *badger.KV, key string, v VaultFile, added ...string) error {
 	kb := []byte(key)
-	valueJson, err := json.Marshal(&v)
+	vb, err := encodeRecord(&v)
 	if err != nil {
-		log.Fatal("Error encoding struct as json")
+		return err
+	}
+	entries := badger.EntriesSet([]*badger.Entry{}, kb, vb)
+	for _, alias := range v.Aliases {
+		if containsString(added, alias) {
+			continue
+		}
+		_, found, err := getAliasDigest(kv, alias)
+		if err != nil {
+			return &DbError{op: "read", err: err}
+		}
+		if !found {
+			entries = badger.EntriesSet(entries, []byte(ALIAS_PREFIX+alias), kb)
+		}
 	}
-	vb := []byte(string(valueJson))
-	kv.Set(kb, vb)
+	for _, alias := range added {
+		entries = badger.EntriesSet(entries, []byte(ALIAS_PREFIX+alias), kb)
+	}
+	err = writeBatch(kv, entries)
+	if err != nil {
+		return &DbError{op: "write", err: err}
+	}
+	return nil
 }
 
-func updateVaultFileWithDigest(kv *badger.KV, key string, glacierId string) error {
-	vf, err := getVaultFile(kv, key)
+// Write all the entries at once
+func writeBatch(kv *badger.KV, entries []*badger.Entry) error {
+	err := kv.BatchSet(entries)
 	if err != nil {
 		return err
 	}
-	vf.Glacier = glacierId
-	insertVaultFile(kv, key, vf)
+	for _, e := range entries {
+		if e.Error != nil {
+			return e.Error
+		}
+	}
 	return nil
 }
 
-// Get VaultFile object by key
-func getVaultFile(kv *badger.KV, key string) (VaultFile, error) {
+// vaultFileLock serialises the read-modify-write updates of VaultFile records
+var vaultFileLock sync.Mutex
+
+// Record where the backend stored the file with digest key
+// It is safe to call concurrently
+func updateVaultFileWithDigest(kv *badger.KV, key, backend, remote, locator, storageClass string) error {
+	vaultFileLock.Lock()
+	defer vaultFileLock.Unlock()
+	vf, err := getVaultFile(kv, key)
+	if err != nil {
+		return err
+	}
+	vf.Backend = backend
+	vf.Remote = remote
+	vf.Locator = locator
+	vf.StorageClass = storageClass
+	vf.PushedAt = time.Now()
+	vf.Missing = false
+	return insertVaultFile(kv, key, vf)
+}
+
+// Copy the value of the item, nil if the key has none
+func itemValue(item *badger.KVItem) ([]byte, error) {
+	var value []byte
+	err := item.Value(func(v []byte) error {
+		if v != nil {
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+// Get the value of the key, nil if the kv has none
+func getValue(kv *badger.KV, key []byte) ([]byte, error) {
 	var item badger.KVItem
+	err := kv.Get(key, &item)
+	if err != nil {
+		return nil, err
+	}
+	return itemValue(&item)
+}
 
-	err := kv.Get([]byte(key), &item)
+// Get VaultFile object by key
+func getVaultFile(kv *badger.KV, key string) (VaultFile, error) {
+	value, err := getValue(kv, []byte(key))
 	if err != nil {
 		return VaultFile{}, err
 	}
-	vf := VaultFile{}
-	err = json.Unmarshal(item.Value(), &vf)
+	return decodeVaultFile(value)
+}
+
+type AliasNotFoundError struct {
+	alias string
+}
+
+func (e *AliasNotFoundError) Error() string {
+	return fmt.Sprintf("No vault file found for alias: %s", e.alias)
+}
+
+// Whether the key is the key of a VaultFile record
+func isVaultFileKey(key string) bool {
+	return !strings.Contains(key, KEY_SEP)
+}
+
+// Call f for every record whose key starts with prefix, in key order
+// The prefix is trimmed from the key passed to f
+func forEachWithPrefix(kv *badger.KV, prefix string, f func(key string, value []byte) error) error {
+	itr := kv.NewIterator(badger.DefaultIteratorOptions)
+	defer itr.Close()
+	for itr.Seek([]byte(prefix)); itr.Valid(); itr.Next() {
+		item := itr.Item()
+		key := string(item.Key())
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+		value, err := itemValue(item)
+		if err != nil {
+			return err
+		}
+		err = f(strings.TrimPrefix(key, prefix), value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Call f for every VaultFile record in the kv, in key order
+func forEachVaultFile(kv *badger.KV, f func(key string, vf VaultFile)) error {
+	itr := kv.NewIterator(badger.DefaultIteratorOptions)
+	defer itr.Close()
+	for itr.Rewind(); itr.Valid(); itr.Next() {
+		item := itr.Item()
+		if !isVaultFileKey(string(item.Key())) {
+			continue
+		}
+		value, err := itemValue(item)
+		if err != nil {
+			return err
+		}
+		vf, err := decodeVaultFile(value)
+		if err != nil {
+			return err
+		}
+		f(string(item.Key()), vf)
+	}
+	return nil
+}
+
+// Get VaultFile object by one of its aliases, through the alias index
+func getVaultFileByAlias(kv *badger.KV, alias string) (VaultFile, error) {
+	digest, found, err := getAliasDigest(kv, alias)
 	if err != nil {
 		return VaultFile{}, err
 	}
-	return vf, nil
+	if !found {
+		return VaultFile{}, &AliasNotFoundError{alias: alias}
+	}
+	return getVaultFile(kv, digest)
+}
+
+// Save the upload state of the file with digest key
+func putUploadState(kv *badger.KV, key string, state UploadState) error {
+	value, err := encodeRecord(&state)
+	if err != nil {
+		return err
+	}
+	return kv.Set([]byte(UPLOAD_PREFIX+key), value, 0)
+}
+
+// Get the upload state of the file with digest key
+// Return false if there is no upload in flight for the file
+func getUploadState(kv *badger.KV, key string) (UploadState, bool, error) {
+	value, err := getValue(kv, []byte(UPLOAD_PREFIX+key))
+	if err != nil {
+		return UploadState{}, false, err
+	}
+	if value == nil {
+		return UploadState{}, false, nil
+	}
+	state := UploadState{}
+	err = decodeRecord(value, &state)
+	if err != nil {
+		return UploadState{}, false, err
+	}
+	return state, true, nil
+}
+
+func deleteUploadState(kv *badger.KV, key string) error {
+	return kv.Delete([]byte(UPLOAD_PREFIX + key))
+}
+
+// Call f for every saved upload state with the digest of its file
+func forEachUploadState(kv *badger.KV, f func(key string, state UploadState) error) error {
+	return forEachWithPrefix(kv, UPLOAD_PREFIX, func(key string, value []byte) error {
+		state := UploadState{}
+		err := decodeRecord(value, &state)
+		if err != nil {
+			return err
+		}
+		return f(key, state)
+	})
 }
@@ -1,6 +1,7 @@
-package main
+package vault
 
 import (
+	"io/ioutil"
 	"os"
 	"testing"
 )
@@ -13,10 +14,13 @@ func TestInsert(t *testing.T) {
 		Hash:    hash,
 		Aliases: []string{"foo/bar", "foo"},
 		Glacier: "",
-		KeyId:   "C21B7817",
+		KeyIds:  []string{"C21B7817"},
 	}
 
-	kv := LoadBadger(os.TempDir())
+	dir, _ := ioutil.TempDir("", "vault")
+	defer os.RemoveAll(dir)
+	kv, _ := LoadBadger(dir)
+	defer kv.Close()
 	insertVaultFile(kv, hash, vf)
 	vf, err := getVaultFile(kv, hash)
 
@@ -33,14 +37,17 @@ func TestInsert(t *testing.T) {
 	if vf.Glacier != "" {
 		t.Fatal("wrong glaicer id")
 	}
-	if vf.KeyId != "C21B7817" {
+	if len(vf.KeyIds) != 1 || vf.KeyIds[0] != "C21B7817" {
 		t.Fatal("wrong keyid")
 	}
 }
 
 // Insert a new VaultFile and then get a non-existing key
 func TestInsert2(t *testing.T) {
-	kv := LoadBadger(os.TempDir())
+	dir, _ := ioutil.TempDir("", "vault")
+	defer os.RemoveAll(dir)
+	kv, _ := LoadBadger(dir)
+	defer kv.Close()
 	vf := VaultFile{}
 	insertVaultFile(kv, "1", vf)
 	_, err := getVaultFile(kv, "2")
@@ -48,3 +55,55 @@ func TestInsert2(t *testing.T) {
 		t.Fatal("expect error here")
 	}
 }
+
+// Records written before backends were introduced only have a glacier id
+func TestDecodeLegacyVaultFile(t *testing.T) {
+	legacy := `{"hash":"1","aliases":["foo"],"glacier":"archive-1","keyid":"C21B7817"}`
+	vf, err := decodeVaultFile([]byte(legacy))
+	if err != nil {
+		t.Fatal("error decoding: ", err.Error())
+	}
+	if vf.Backend != BACKEND_GLACIER || vf.Locator != "archive-1" || vf.Glacier != "" {
+		t.Fatal("wrong backend or locator")
+	}
+	if len(vf.KeyIds) != 1 || vf.KeyIds[0] != "C21B7817" || vf.KeyId != "" {
+		t.Fatal("the key id should be read into the recipients")
+	}
+	if vf.Size != 0 || !vf.PushedAt.IsZero() || len(vf.Meta) != 0 {
+		t.Fatal("legacy records have no metadata")
+	}
+}
+
+// Upload states are kept apart from the VaultFile records
+func TestUploadState(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "vault")
+	defer os.RemoveAll(dir)
+	kv, _ := LoadBadger(dir)
+	defer kv.Close()
+	insertVaultFile(kv, "1", VaultFile{Hash: "1"})
+
+	if _, found, _ := getUploadState(kv, "1"); found {
+		t.Fatal("there should be no upload state")
+	}
+	state := UploadState{Remote: "photos", UploadId: "upload-1", PartSize: MiB, Size: 3 * MiB, Parts: []string{"a"}}
+	if err := putUploadState(kv, "1", state); err != nil {
+		t.Fatal("error saving upload state: ", err.Error())
+	}
+	saved, found, err := getUploadState(kv, "1")
+	if err != nil || !found || saved.UploadId != "upload-1" || len(saved.Parts) != 1 {
+		t.Fatal("wrong upload state: ", saved, err)
+	}
+
+	count := 0
+	forEachVaultFile(kv, func(key string, vf VaultFile) {
+		count++
+	})
+	if count != 1 {
+		t.Fatal("upload states should not be read as vault files")
+	}
+
+	deleteUploadState(kv, "1")
+	if _, found, _ := getUploadState(kv, "1"); found {
+		t.Fatal("upload state should be deleted")
+	}
+}
@@ -0,0 +1,154 @@
+package vault
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Exit codes of the vault command, decided by ExitCode from the returned error
+const (
+	EXIT_FAILURE = 1 // some files failed, or an unclassified error
+	EXIT_USAGE   = 2 // invalid command, flags or arguments, as the flag package
+	EXIT_CONFIG  = 3 // no vault, or an invalid config
+	EXIT_KEY     = 4 // keyring missing, key not found or wrong passphrase
+	EXIT_REMOTE  = 5 // the remote storage failed
+	EXIT_DB      = 6 // the local data store failed
+)
+
+// UsageError is returned when a command is invoked with invalid arguments
+type UsageError struct {
+	msg string
+}
+
+// Return a new UsageError with the message
+func NewUsageError(msg string) *UsageError {
+	return &UsageError{msg: msg}
+}
+
+func (e *UsageError) Error() string {
+	return e.msg
+}
+
+// ConfigError is returned when a config value is invalid
+type ConfigError struct {
+	key   string
+	value string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("Invalid config %s: %s", e.key, e.value)
+}
+
+// KeyringMissingError is returned when an openpgp keyring cannot be read
+type KeyringMissingError struct {
+	path string
+	err  error
+}
+
+func (e *KeyringMissingError) Error() string {
+	return fmt.Sprintf("Cannot read the keyring %s: %s", e.path, e.err.Error())
+}
+
+func (e *KeyringMissingError) Unwrap() error {
+	return e.err
+}
+
+// KeyNotFoundError is returned when no key of the keyring has the key id
+type KeyNotFoundError struct {
+	keyId string
+}
+
+func (e *KeyNotFoundError) Error() string {
+	return fmt.Sprintf("No key found for key id: %s", e.keyId)
+}
+
+// WrongPassphraseError is returned when a private key cannot be decrypted
+type WrongPassphraseError struct {
+	keyId string
+}
+
+func (e *WrongPassphraseError) Error() string {
+	if e.keyId == "" {
+		return "Wrong passphrase"
+	}
+	return fmt.Sprintf("Wrong passphrase for key id: %s", e.keyId)
+}
+
+// RemoteError wraps an error of the remote storage
+type RemoteError struct {
+	op  string // get, put, delete or list
+	err error
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("remote %s failed: %s", e.op, e.err.Error())
+}
+
+func (e *RemoteError) Unwrap() error {
+	return e.err
+}
+
+// DbError wraps an error of the local data store
+type DbError struct {
+	op  string // what was done, e.g. open or write
+	err error
+}
+
+func (e *DbError) Error() string {
+	return fmt.Sprintf("vault db %s failed: %s", e.op, e.err.Error())
+}
+
+func (e *DbError) Unwrap() error {
+	return e.err
+}
+
+// FailuresError is returned when a command went through, but some of the
+// files failed, after they have been reported
+type FailuresError struct {
+	count int
+	what  string // what went wrong, e.g. files failed to push
+}
+
+func (e *FailuresError) Error() string {
+	return fmt.Sprintf("%d %s", e.count, e.what)
+}
+
+// FileFailure is a file that a command failed to process, and why
+type FileFailure struct {
+	Path string
+	Err  error
+}
+
+// ExitCode gets the exit code of the vault command for the error it returned
+func ExitCode(err error) int {
+	var (
+		usage          *UsageError
+		config         *ConfigError
+		noVault        *NoVaultFoundError
+		unknownBackend *UnknownBackendError
+		storageClass   *InvalidStorageClassError
+		partSize       *InvalidPartSizeError
+		keyring        *KeyringMissingError
+		keyNotFound    *KeyNotFoundError
+		passphrase     *WrongPassphraseError
+		pgpMismatch    *PgpMismatchError
+		remote         *RemoteError
+		db             *DbError
+		schema         *UnsupportedSchemaError
+	)
+	switch {
+	case errors.As(err, &usage):
+		return EXIT_USAGE
+	case errors.As(err, &config), errors.As(err, &noVault), errors.As(err, &unknownBackend),
+		errors.As(err, &storageClass), errors.As(err, &partSize):
+		return EXIT_CONFIG
+	case errors.As(err, &keyring), errors.As(err, &keyNotFound), errors.As(err, &passphrase),
+		errors.As(err, &pgpMismatch):
+		return EXIT_KEY
+	case errors.As(err, &remote):
+		return EXIT_REMOTE
+	case errors.As(err, &db), errors.As(err, &schema):
+		return EXIT_DB
+	}
+	return EXIT_FAILURE
+}
@@ -0,0 +1,33 @@
+package vault
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Wrapped errors exit with the code of their type
+func TestExitCode(t *testing.T) {
+	cases := []struct {
+		err  error
+		code int
+	}{
+		{&UsageError{msg: "Please specify a file"}, EXIT_USAGE},
+		{NewUsageError("Unknown command: foo"), EXIT_USAGE},
+		{&ConfigError{key: "partsize", value: "x"}, EXIT_CONFIG},
+		{&NoVaultFoundError{dir: "/"}, EXIT_CONFIG},
+		{&UnknownBackendError{name: "ftp"}, EXIT_CONFIG},
+		{&KeyNotFoundError{keyId: "C21B7817"}, EXIT_KEY},
+		{&WrongPassphraseError{}, EXIT_KEY},
+		{fmt.Errorf("Fail to fetch a: %w", &KeyringMissingError{path: "secring.gpg", err: fmt.Errorf("missing")}), EXIT_KEY},
+		{&RemoteError{op: "put", err: fmt.Errorf("timeout")}, EXIT_REMOTE},
+		{fmt.Errorf("Fail to fetch a: %w", &RemoteError{op: "get", err: fmt.Errorf("timeout")}), EXIT_REMOTE},
+		{&DbError{op: "open", err: fmt.Errorf("locked")}, EXIT_DB},
+		{&FailuresError{count: 2, what: "files failed to push"}, EXIT_FAILURE},
+		{fmt.Errorf("unclassified"), EXIT_FAILURE},
+	}
+	for _, c := range cases {
+		if code := ExitCode(c.err); code != c.code {
+			t.Fatal("wrong exit code for ", c.err.Error(), ": ", code)
+		}
+	}
+}
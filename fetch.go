@@ -0,0 +1,218 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+import (
+	"github.com/dgraph-io/badger"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+type NotPushedError struct {
+	alias string
+}
+
+func (e *NotPushedError) Error() string {
+	return fmt.Sprintf("%s is neither pushed nor cached", e.alias)
+}
+
+// FetchOptions tune a fetch
+type FetchOptions struct {
+	KeepLocal  bool // preserve the local file when it differs
+	KeepRemote bool // replace the local file when it differs
+	Backend    BackendOptions
+	Progress   io.Writer // progress messages are written to it, nil for none
+	// Confirm asks whether to replace a local file that differs when neither
+	// KeepLocal nor KeepRemote is set, the file is preserved if it is nil
+	Confirm func(question string) bool
+}
+
+// Compute the tree hash of a local file
+func localTreeHash(fn string) (string, error) {
+	file, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return TreeHash(file), nil
+}
+
+// Download the encrypted object of vf from the backend into the tmp directory
+// Return the path of the downloaded file
+func retrieveArchive(ctx context.Context, vaultDir string, backend Backend, vf VaultFile) (string, error) {
+	if err := checkBackend(backend, vf.Hash, vf.Backend, vf.Remote); err != nil {
+		return "", err
+	}
+	tmpDir := makePath(vaultDir, CONF_DIR, TMP)
+	createEmptyDir(tmpDir)
+	fn := makePath(tmpDir, vf.Hash)
+	err := backend.Get(ctx, vf.Locator, fn)
+	if err != nil {
+		os.Remove(fn)
+		return "", &RemoteError{op: "get", err: err}
+	}
+	return fn, nil
+}
+
+// Restore the permissions, times and owner recorded when the file was added
+// The owner is only restored when running as root
+func applyFileMeta(fn string, meta FileMeta) error {
+	err := os.Chmod(fn, meta.Mode.Perm())
+	if err != nil {
+		return err
+	}
+	if !meta.Mtime.IsZero() {
+		err = os.Chtimes(fn, meta.Mtime, meta.Mtime)
+		if err != nil {
+			return err
+		}
+	}
+	if os.Geteuid() == 0 && meta.Uid >= 0 && meta.Gid >= 0 {
+		return os.Chown(fn, meta.Uid, meta.Gid)
+	}
+	return nil
+}
+
+// Fetch a single file by its name relative to the working directory
+// The name may select a version, e.g. a.txt@2 or a.txt@2006-01-02
+func fetchFile(ctx context.Context, lc *LocalContext, backend Backend, kv *badger.KV, opts FetchOptions, arg string) error {
+	vaultDir := lc.baseDirectory()
+	fn, version := splitVersion(arg)
+	rel, err := resolveVaultPath(vaultDir, fn)
+	if err != nil {
+		return err
+	}
+	alias := makePath(vaultDir, rel)
+	vf, err := getVaultFileVersion(kv, alias, version)
+	if err != nil {
+		return err
+	}
+
+	localExists := dirExists(alias)
+	if localExists {
+		digest, err := localTreeHash(alias)
+		if err != nil {
+			return err
+		}
+		if digest == vf.Hash {
+			progressf(opts.Progress, "%s is identical to the remote one\n", fn)
+			return nil
+		}
+		if opts.KeepLocal {
+			progressf(opts.Progress, "%s differs from the remote one, local file preserved\n", fn)
+			return nil
+		}
+	}
+
+	// a file that is not pushed yet can still be restored from the cache
+	encryptedFn := makePath(vaultDir, CONF_DIR, CACHE, vf.Hash)
+	if vf.Locator != "" {
+		encryptedFn, err = retrieveArchive(ctx, vaultDir, backend, vf)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(encryptedFn)
+	} else if !dirExists(encryptedFn) {
+		return &NotPushedError{alias: alias}
+	}
+
+	prompt, err := promptFromContext(lc)
+	if err != nil {
+		return err
+	}
+	config := &packet.Config{
+		DefaultCompressionAlgo: 1,
+		CompressionConfig:      &packet.CompressionConfig{Level: 5},
+	}
+	tmpDir := makePath(vaultDir, CONF_DIR, TMP)
+	createEmptyDir(tmpDir)
+	decryptedFn, err := DecryptFile(encryptedFn, tmpDir, config, prompt)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(decryptedFn)
+	digest, err := localTreeHash(decryptedFn)
+	if err != nil {
+		return err
+	}
+	if digest != vf.Hash {
+		return &ChecksumMismatchError{expected: vf.Hash, actual: digest}
+	}
+
+	if localExists && !opts.KeepRemote {
+		question := fmt.Sprintf("%s differs from the remote one, replace it?", fn)
+		if opts.Confirm == nil || !opts.Confirm(question) {
+			progressf(opts.Progress, "%s preserved\n", fn)
+			return nil
+		}
+	}
+	err = os.MkdirAll(filepath.Dir(alias), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(decryptedFn, alias)
+	if err != nil {
+		return err
+	}
+	// the temporary file is only readable by its owner, so a file without
+	// metadata gets the mode files are written with
+	if meta, ok := vf.Meta[alias]; ok {
+		err = applyFileMeta(alias, meta)
+	} else {
+		err = os.Chmod(alias, 0664)
+	}
+	if err != nil {
+		return err
+	}
+	progressf(opts.Progress, "%s fetched\n", fn)
+	return nil
+}
+
+// Fetch the files, named relative to the working directory as the ones given
+// to Add, from the remote or from the cache
+// No more file is started once the context is done
+// Return the files that failed, and FailuresError if there are any
+func (v *Vault) Fetch(ctx context.Context, fns []string, opts FetchOptions) ([]FileFailure, error) {
+	failures := []FileFailure{}
+	if opts.KeepLocal && opts.KeepRemote {
+		return failures, &UsageError{msg: "--local and --remote cannot be used together"}
+	}
+	if len(fns) == 0 {
+		return failures, &UsageError{msg: "Please specify the files to fetch"}
+	}
+	kv, err := LoadBadger(makePath(v.baseDirectory(), CONF_DIR, DB))
+	if err != nil {
+		return failures, err
+	}
+	defer kv.Close()
+	lc, err := NewLocalContext(v, kv, true)
+	if err != nil {
+		return failures, err
+	}
+	awsCtx, err := NewAWSContext(v)
+	if err != nil {
+		return failures, err
+	}
+	backend, err := NewBackend(&awsCtx, opts.Backend)
+	if err != nil {
+		return failures, err
+	}
+	for _, fn := range fns {
+		if err := ctx.Err(); err != nil {
+			return failures, err
+		}
+		err := fetchFile(ctx, &lc, backend, kv, opts, fn)
+		if err != nil {
+			failures = append(failures, FileFailure{Path: fn, Err: err})
+		}
+	}
+	if len(failures) > 0 {
+		return failures, &FailuresError{count: len(failures), what: "files failed to fetch"}
+	}
+	return failures, nil
+}
@@ -0,0 +1,183 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// newFetchVaultForTest initialises a vault with a file backend, and adds the
+// file a.txt to it
+func newFetchVaultForTest(t *testing.T) (*Vault, string) {
+	dir, _ := ioutil.TempDir("", "vault")
+	remoteDir := makePath(dir, "remote")
+	os.Mkdir(remoteDir, 0755)
+	v, err := Init(dir, testPassphrase, InitOptions{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	WriteConfig(makePath(dir, CONF_DIR, CONFIG), map[string]string{"signingkey": "C21B7817", "remote": "file://" + remoteDir})
+	ioutil.WriteFile(makePath(dir, "a.txt"), []byte("remote"), 0644)
+	if _, err = v.Add(context.Background(), []string{makePath(dir, "a.txt")}, AddOptions{}); err != nil {
+		t.Fatal("error adding: ", err)
+	}
+	return v, dir
+}
+
+// Fetch a file which is only cached
+func TestFetchFromCache(t *testing.T) {
+	v, dir := newFetchVaultForTest(t)
+	defer os.RemoveAll(dir)
+	os.Remove(makePath(dir, "a.txt"))
+
+	failures, err := v.Fetch(context.Background(), []string{makePath(dir, "a.txt")}, FetchOptions{})
+	if err != nil || len(failures) != 0 {
+		t.Fatal("fetch fails: ", failures, err)
+	}
+	content, err := ioutil.ReadFile(makePath(dir, "a.txt"))
+	if err != nil || string(content) != "remote" {
+		t.Fatal("wrong fetched content")
+	}
+	files, _ := ioutil.ReadDir(makePath(dir, CONF_DIR, CACHE))
+	if len(files) != 1 {
+		t.Fatal("only the encrypted file should be left in the cache: ", len(files))
+	}
+}
+
+// Fetch a file pushed to a file backend
+func TestFetchFromBackend(t *testing.T) {
+	v, dir := newFetchVaultForTest(t)
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	if _, err := v.Push(ctx, PushOptions{Jobs: 1}); err != nil {
+		t.Fatal("push fails: ", err)
+	}
+	os.Remove(makePath(dir, "a.txt"))
+
+	failures, err := v.Fetch(ctx, []string{makePath(dir, "a.txt")}, FetchOptions{})
+	if err != nil || len(failures) != 0 {
+		t.Fatal("fetch fails: ", failures, err)
+	}
+	content, err := ioutil.ReadFile(makePath(dir, "a.txt"))
+	if err != nil || string(content) != "remote" {
+		t.Fatal("wrong fetched content")
+	}
+	if _, err = v.Fetch(ctx, []string{makePath(dir, "b.txt")}, FetchOptions{}); err == nil {
+		t.Fatal("an unknown file should fail")
+	}
+
+	// the file is not asked from another directory
+	os.Remove(makePath(dir, "a.txt"))
+	otherDir := makePath(dir, "other")
+	os.Mkdir(otherDir, 0755)
+	WriteConfig(makePath(dir, CONF_DIR, CONFIG), map[string]string{"signingkey": "C21B7817", "remote": "file://" + otherDir})
+	failures, _ = v.Fetch(ctx, []string{makePath(dir, "a.txt")}, FetchOptions{})
+	if len(failures) != 1 {
+		t.Fatal("expect the fetch to fail")
+	}
+	if _, ok := failures[0].Err.(*BackendMismatchError); !ok {
+		t.Fatal("expect a backend mismatch: ", failures[0].Err)
+	}
+}
+
+// A local file that differs is only replaced when asked to
+func TestFetchConflict(t *testing.T) {
+	v, dir := newFetchVaultForTest(t)
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	fn := makePath(dir, "a.txt")
+	fetch := func(opts FetchOptions) string {
+		ioutil.WriteFile(fn, []byte("local"), 0644)
+		if _, err := v.Fetch(ctx, []string{makePath(dir, "a.txt")}, opts); err != nil {
+			t.Fatal("fetch fails: ", err)
+		}
+		content, _ := ioutil.ReadFile(fn)
+		return string(content)
+	}
+
+	if _, err := v.Fetch(ctx, []string{makePath(dir, "a.txt")}, FetchOptions{KeepLocal: true, KeepRemote: true}); err == nil {
+		t.Fatal("--local and --remote cannot be used together")
+	}
+	if fetch(FetchOptions{KeepLocal: true}) != "local" {
+		t.Fatal("the local file should be preserved")
+	}
+	if fetch(FetchOptions{}) != "local" {
+		t.Fatal("the local file should be preserved without confirmation")
+	}
+	no := func(string) bool { return false }
+	if fetch(FetchOptions{Confirm: no}) != "local" {
+		t.Fatal("the local file should be preserved when declined")
+	}
+	yes := func(string) bool { return true }
+	if fetch(FetchOptions{Confirm: yes}) != "remote" {
+		t.Fatal("the local file should be replaced when confirmed")
+	}
+	if fetch(FetchOptions{KeepRemote: true}) != "remote" {
+		t.Fatal("the local file should be replaced")
+	}
+}
+
+// Nothing is fetched when the passphrase cannot be had or is wrong
+func TestFetchPassphrase(t *testing.T) {
+	v, dir := newFetchVaultForTest(t)
+	defer os.RemoveAll(dir)
+	os.Remove(makePath(dir, "a.txt"))
+	ctx := context.Background()
+
+	failed := errors.New("no terminal")
+	v.passphrase = func() ([]byte, error) { return nil, failed }
+	if _, err := v.Fetch(ctx, []string{makePath(dir, "a.txt")}, FetchOptions{}); err != failed {
+		t.Fatal("expect the prompt error: ", err)
+	}
+
+	v.passphrase = func() ([]byte, error) { return []byte("wrong"), nil }
+	failures, err := v.Fetch(ctx, []string{makePath(dir, "a.txt")}, FetchOptions{})
+	if _, ok := err.(*FailuresError); !ok || len(failures) != 1 {
+		t.Fatal("expect the file to fail: ", err)
+	}
+	if _, ok := failures[0].Err.(*WrongPassphraseError); !ok {
+		t.Fatal("expect a wrong passphrase: ", failures[0].Err)
+	}
+	if dirExists(makePath(dir, "a.txt")) {
+		t.Fatal("nothing should be fetched")
+	}
+}
+
+// A file added from a subdirectory is fetched by the same path, and gets the
+// default mode when it has no metadata
+func TestFetchFromSubdirectory(t *testing.T) {
+	v, dir := newFetchVaultForTest(t)
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	ctx := context.Background()
+	os.Mkdir(makePath(dir, "docs"), 0755)
+	ioutil.WriteFile(makePath(dir, "docs", "b.txt"), []byte("docs"), 0600)
+	os.Chdir(makePath(dir, "docs"))
+	if _, err := v.Add(ctx, []string{"b.txt"}, AddOptions{}); err != nil {
+		t.Fatal("error adding: ", err)
+	}
+	kv, _ := LoadBadger(makePath(dir, CONF_DIR, DB))
+	vf, _ := getVaultFileByAlias(kv, makePath(dir, "docs", "b.txt"))
+	vf.Meta = nil
+	insertVaultFile(kv, vf.Hash, vf)
+	kv.Close()
+	os.Remove("b.txt")
+
+	failures, err := v.Fetch(ctx, []string{"b.txt"}, FetchOptions{})
+	if err != nil || len(failures) != 0 {
+		t.Fatal("fetch fails: ", failures, err)
+	}
+	content, err := ioutil.ReadFile("b.txt")
+	if err != nil || string(content) != "docs" {
+		t.Fatal("wrong fetched content")
+	}
+	if fi, _ := os.Stat("b.txt"); fi.Mode().Perm() != 0664 {
+		t.Fatal("expect the default mode: ", fi.Mode())
+	}
+	if _, err := v.Fetch(ctx, []string{wd}, FetchOptions{}); err == nil {
+		t.Fatal("a file outside the vault should fail")
+	}
+}
@@ -0,0 +1,321 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/dgraph-io/badger"
+)
+
+// in-flight multipart uploads idle for longer than this are aborted, glacier
+// may have expired them already
+const UPLOAD_TTL = 24 * time.Hour
+
+type InvalidPartSizeError struct {
+	size int64
+}
+
+func (e *InvalidPartSizeError) Error() string {
+	return fmt.Sprintf("Invalid part size %d, it must be a power of two MiB up to 4 GiB", e.size)
+}
+
+// GlacierBackend stores the cache objects as archives of a glacier vault
+// Files larger than multipartMin are uploaded in parts of partSize bytes
+// With a kv, the progress of multipart uploads is saved in it, and an upload
+// interrupted by a previous push is resumed
+type GlacierBackend struct {
+	vault        string
+	multipartMin int64
+	partSize     int64
+	opts         BackendOptions
+	service      *glacier.Glacier
+	kv           *badger.KV
+}
+
+func NewGlacierBackend(region, vault string, multipartMin, partSize int64, opts BackendOptions) (*GlacierBackend, error) {
+	if !validPartSize(partSize) {
+		return nil, &InvalidPartSizeError{size: partSize}
+	}
+	return &GlacierBackend{
+		vault:        vault,
+		multipartMin: multipartMin,
+		partSize:     partSize,
+		opts:         opts,
+		service:      NewService(region),
+	}, nil
+}
+
+func (b *GlacierBackend) Name() string {
+	return BACKEND_GLACIER
+}
+
+func (b *GlacierBackend) Target() string {
+	return b.vault
+}
+
+// Put uploads the file as an archive, the locator is the archive id
+func (b *GlacierBackend) Put(fn string) (string, error) {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return "", err
+	}
+	var resp *glacier.ArchiveCreationOutput
+	if fi.Size() > b.multipartMin {
+		resp, err = b.putMultipart(fn, fi.Size())
+	} else {
+		resp, err = UploadFile(fn, b.vault, b.service)
+	}
+	if err != nil {
+		return "", err
+	}
+	return *resp.ArchiveId, nil
+}
+
+func (b *GlacierBackend) resumeWith(kv *badger.KV) {
+	b.kv = kv
+}
+
+// Whether a saved upload can be resumed for a file of the size
+// The saved parts are checked against the parts glacier has received, and the
+// upload resumes after the last part both agree on
+// Return false if glacier dropped the upload, which it does after a day
+func (b *GlacierBackend) resumable(state *UploadState, size int64) (bool, error) {
+	if state.Remote != b.vault || state.PartSize != b.partSize || state.Size != size {
+		return false, nil
+	}
+	if time.Since(state.Updated) > UPLOAD_TTL {
+		return false, nil
+	}
+	uploaded, err := ListUploadedParts(b.vault, state.UploadId, b.service)
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	state.Parts = verifiedParts(*state, uploaded)
+	return true, nil
+}
+
+// Return the saved parts of the upload, up to the first one glacier did not
+// receive with the same tree hash
+func verifiedParts(state UploadState, uploaded map[int64]string) []string {
+	parts := []string{}
+	for i, hash := range state.Parts {
+		if uploaded[int64(i)*state.PartSize] != hash {
+			break
+		}
+		parts = append(parts, hash)
+	}
+	return parts
+}
+
+// Upload the file in parts, resuming the saved upload of the file if any
+// Without a kv, the upload is aborted when it fails, otherwise it is kept to
+// be resumed by the next push
+func (b *GlacierBackend) putMultipart(fn string, size int64) (*glacier.ArchiveCreationOutput, error) {
+	key := filepath.Base(fn)
+	save := func(state UploadState) error {
+		return nil
+	}
+	var state UploadState
+	found := false
+	if b.kv != nil {
+		save = func(state UploadState) error {
+			return putUploadState(b.kv, key, state)
+		}
+		var err error
+		state, found, err = getUploadState(b.kv, key)
+		if err != nil {
+			return nil, err
+		}
+		resume := false
+		if found {
+			resume, err = b.resumable(&state, size)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if found && !resume {
+			if state.Remote == b.vault {
+				AbortMultipart(b.vault, state.UploadId, b.service)
+			}
+			deleteUploadState(b.kv, key)
+			found = false
+		}
+	}
+	if found {
+		progressf(b.opts.Progress, "Resuming upload of %s from part %d\n", key, len(state.Parts))
+	} else {
+		uploadId, err := InitiateMultipart(fn, b.vault, b.partSize, b.service)
+		if err != nil {
+			return nil, err
+		}
+		state = UploadState{
+			Remote:   b.vault,
+			UploadId: uploadId,
+			PartSize: b.partSize,
+			Size:     size,
+			Parts:    []string{},
+			Updated:  time.Now(),
+		}
+		err = save(state)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := UploadParts(fn, b.vault, &state, save, b.service)
+	if err != nil {
+		if b.kv == nil {
+			AbortMultipart(b.vault, state.UploadId, b.service)
+		}
+		return nil, err
+	}
+	resp, err := CompleteMultipart(b.vault, state, b.service)
+	if err != nil && isRetryable(err) && b.kv != nil {
+		// the uploaded parts are kept for the next push to complete them
+		return nil, err
+	}
+	if err != nil {
+		// the parts cannot be completed as they are, so start over next time
+		AbortMultipart(b.vault, state.UploadId, b.service)
+	}
+	if b.kv != nil {
+		deleteUploadState(b.kv, key)
+	}
+	return resp, err
+}
+
+// cleanUploads aborts the in-flight uploads that cannot be resumed
+// Saved uploads are stale if they are idle for longer than UPLOAD_TTL or their
+// cache file is gone; uploads of files in cacheDir without a saved state are
+// orphaned
+func (b *GlacierBackend) cleanUploads(cacheDir string) error {
+	if b.kv == nil {
+		return nil
+	}
+	saved := make(map[string]bool)
+	stale := []string{}
+	err := forEachUploadState(b.kv, func(key string, state UploadState) error {
+		if state.Remote != b.vault {
+			return nil
+		}
+		if time.Since(state.Updated) > UPLOAD_TTL || !dirExists(makePath(cacheDir, key)) {
+			AbortMultipart(b.vault, state.UploadId, b.service)
+			stale = append(stale, key)
+			return nil
+		}
+		saved[state.UploadId] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range stale {
+		deleteUploadState(b.kv, key)
+	}
+
+	uploads, err := ListMultipart(b.vault, b.service)
+	if err != nil {
+		return err
+	}
+	for _, upload := range uploads {
+		uploadId := aws.StringValue(upload.MultipartUploadId)
+		description := aws.StringValue(upload.ArchiveDescription)
+		if saved[uploadId] || !strings.HasPrefix(description, cacheDir+"/") {
+			continue
+		}
+		progressf(b.opts.Progress, "Aborting orphaned upload of %s\n", description)
+		AbortMultipart(b.vault, uploadId, b.service)
+	}
+	return nil
+}
+
+// Get initiates an archive retrieval job, waits for it and downloads the
+// archive
+func (b *GlacierBackend) Get(ctx context.Context, locator, ofn string) error {
+	jobId, err := InitiateRetrieval(locator, b.vault, b.opts.Tier, b.service)
+	if err != nil {
+		return err
+	}
+	progressf(b.opts.Progress, "Retrieval job %s started, waiting for glacier\n", jobId)
+	_, err = WaitForJob(ctx, jobId, b.vault, b.opts.Interval, b.service)
+	if err != nil {
+		return err
+	}
+	return DownloadJobOutput(jobId, b.vault, ofn, b.service)
+}
+
+// GetBatch starts a retrieval job for every archive first, and then waits for
+// them in turn
+// No more job is waited for once the context is done
+func (b *GlacierBackend) GetBatch(ctx context.Context, files map[string]string) map[string]error {
+	errs := make(map[string]error)
+	jobs := make(map[string]string)
+	for _, locator := range sortedKeys(files) {
+		jobId, err := InitiateRetrieval(locator, b.vault, b.opts.Tier, b.service)
+		if err != nil {
+			errs[locator] = err
+			continue
+		}
+		jobs[locator] = jobId
+	}
+	progressf(b.opts.Progress, "%d retrieval jobs started, waiting for glacier\n", len(jobs))
+	for _, locator := range sortedKeys(jobs) {
+		jobId := jobs[locator]
+		_, err := WaitForJob(ctx, jobId, b.vault, b.opts.Interval, b.service)
+		if err == nil {
+			err = DownloadJobOutput(jobId, b.vault, files[locator], b.service)
+		}
+		if err != nil {
+			errs[locator] = err
+		}
+	}
+	return errs
+}
+
+func (b *GlacierBackend) Delete(locator string) error {
+	return DeleteArchive(locator, b.vault, b.service)
+}
+
+// List initiates an inventory retrieval job, waits for it and returns the
+// archives in the inventory
+// Glacier takes the inventory about once a day, the time of the listing is
+// the inventory date
+func (b *GlacierBackend) List(ctx context.Context) ([]RemoteObject, time.Time, error) {
+	jobId, err := InitiateInventory(b.vault, b.service)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	progressf(b.opts.Progress, "Inventory job %s started, waiting for glacier\n", jobId)
+	_, err = WaitForJob(ctx, jobId, b.vault, b.opts.Interval, b.service)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	inventory, err := GetInventory(jobId, b.vault, b.service)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	date, err := time.Parse(time.RFC3339, inventory.InventoryDate)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	objects := []RemoteObject{}
+	for _, archive := range inventory.ArchiveList {
+		objects = append(objects, RemoteObject{
+			Locator:     archive.ArchiveId,
+			Description: archive.ArchiveDescription,
+			Size:        archive.Size,
+		})
+	}
+	return objects, date, nil
+}
@@ -0,0 +1,208 @@
+package vault
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/glacier"
+)
+
+func TestValidPartSize(t *testing.T) {
+	for _, size := range []int64{MiB, 2 * MiB, 64 * MiB, MAX_PART_SIZE} {
+		if !validPartSize(size) {
+			t.Fatal("part size should be valid: ", size)
+		}
+	}
+	for _, size := range []int64{0, MiB / 2, 3 * MiB, MiB + 1, 2 * MAX_PART_SIZE} {
+		if validPartSize(size) {
+			t.Fatal("part size should be invalid: ", size)
+		}
+	}
+}
+
+// The tree hash combined from the parts equals the tree hash of the whole
+func TestCombineTreeHashes(t *testing.T) {
+	data := make([]byte, 5*MiB+123)
+	rand.New(rand.NewSource(1)).Read(data)
+	whole := TreeHash(bytes.NewReader(data))
+
+	for _, partSize := range []int64{MiB, 2 * MiB, 8 * MiB} {
+		hashes := [][]byte{}
+		reader := bytes.NewReader(data)
+		for offset := int64(0); offset < int64(len(data)); offset += partSize {
+			part := io.NewSectionReader(reader, offset, partSize)
+			hashes = append(hashes, glacier.ComputeHashes(part).TreeHash)
+		}
+		if combined := hex.EncodeToString(combineTreeHashes(hashes)); combined != whole {
+			t.Fatal("wrong tree hash with part size ", partSize)
+		}
+	}
+}
+
+// The streamed tree hash equals the tree hash of the whole data
+func TestTreeHasher(t *testing.T) {
+	data := make([]byte, 3*MiB+5)
+	rand.New(rand.NewSource(2)).Read(data)
+	for _, size := range []int{0, 1, MiB, MiB + 1, len(data)} {
+		hasher := newTreeHasher()
+		// write in uneven pieces
+		for offset := 0; offset < size; offset += 100000 {
+			end := offset + 100000
+			if end > size {
+				end = size
+			}
+			hasher.Write(data[offset:end])
+		}
+		if hasher.Sum() != TreeHash(bytes.NewReader(data[:size])) {
+			t.Fatal("wrong tree hash for size ", size)
+		}
+	}
+}
+
+// Only the saved parts glacier received are kept when an upload resumes
+func TestVerifiedParts(t *testing.T) {
+	state := UploadState{PartSize: 4, Parts: []string{"a", "b", "c"}}
+	if parts := verifiedParts(state, map[int64]string{0: "a", 4: "b", 8: "c"}); len(parts) != 3 {
+		t.Fatal("expect every part to be kept: ", parts)
+	}
+	if parts := verifiedParts(state, map[int64]string{0: "a", 8: "c"}); len(parts) != 1 || parts[0] != "a" {
+		t.Fatal("expect the parts after a missing one to be uploaded again: ", parts)
+	}
+	if parts := verifiedParts(state, map[int64]string{0: "x", 4: "b"}); len(parts) != 0 {
+		t.Fatal("expect a part with another hash to be uploaded again: ", parts)
+	}
+	if parts := verifiedParts(state, map[int64]string{}); len(parts) != 0 {
+		t.Fatal("expect no part to be kept: ", parts)
+	}
+}
+
+// fakeGlacier serves the upload requests of a glacier vault, and fails to
+// complete the multipart uploads with completeCode
+type fakeGlacier struct {
+	sync.Mutex
+	completeCode   string
+	completeStatus int
+	parts          map[string]string // tree hash of each part by its range
+	aborted        bool
+	archive        []byte // body of the last single part upload
+	archiveHash    string // tree hash of the last single part upload
+}
+
+func (f *fakeGlacier) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	upload := strings.HasSuffix(r.URL.Path, "/multipart-uploads/upload")
+	switch {
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/archives"):
+		f.archive, f.archiveHash = body, r.Header.Get("x-amz-sha256-tree-hash")
+		w.Header().Set("x-amz-archive-id", "archive")
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "POST" && !upload:
+		w.Header().Set("x-amz-multipart-upload-id", "upload")
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "PUT" && upload:
+		rng := strings.TrimSuffix(strings.TrimPrefix(r.Header.Get("Content-Range"), "bytes "), "/*")
+		f.parts[rng] = r.Header.Get("x-amz-sha256-tree-hash")
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "GET" && upload:
+		parts := []map[string]string{}
+		for rng, hash := range f.parts {
+			parts = append(parts, map[string]string{"RangeInBytes": rng, "SHA256TreeHash": hash})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Parts": parts})
+	case r.Method == "POST" && upload:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(f.completeStatus)
+		fmt.Fprintf(w, `{"code":%q,"message":"failed","type":"Server"}`, f.completeCode)
+	case r.Method == "DELETE" && upload:
+		f.aborted = true
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// Return a glacier service sending its requests to the server
+func newFakeGlacierService(server *httptest.Server) *glacier.Glacier {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("key", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	}))
+	return glacier.New(sess)
+}
+
+// A file uploaded in a single part is sent whole with its tree hash
+func TestUploadFile(t *testing.T) {
+	fake := &fakeGlacier{parts: map[string]string{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	dir, _ := ioutil.TempDir("", "vault")
+	defer os.RemoveAll(dir)
+	data := make([]byte, 3*MiB/2)
+	rand.New(rand.NewSource(1)).Read(data)
+	fn := makePath(dir, "digest")
+	ioutil.WriteFile(fn, data, 0644)
+
+	resp, err := UploadFile(fn, "vault", newFakeGlacierService(server))
+	if err != nil || *resp.ArchiveId != "archive" {
+		t.Fatal("upload fails: ", err)
+	}
+	if !bytes.Equal(fake.archive, data) || fake.archiveHash != TreeHash(bytes.NewReader(data)) {
+		t.Fatal("expect the whole file with its tree hash")
+	}
+}
+
+// A multipart upload that fails to complete is kept to be resumed, unless
+// glacier rejects its parts
+func TestCompleteMultipartFailure(t *testing.T) {
+	sleep = func(time.Duration) {}
+	defer func() { sleep = time.Sleep }()
+	fake := &fakeGlacier{completeCode: "ServiceUnavailableException", completeStatus: 503, parts: map[string]string{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "vault")
+	defer os.RemoveAll(dir)
+	fn := makePath(dir, "digest")
+	ioutil.WriteFile(fn, make([]byte, 3*MiB/2), 0644)
+	os.Mkdir(makePath(dir, "db"), 0755)
+	kv, _ := LoadBadger(makePath(dir, "db"))
+	defer kv.Close()
+	b := &GlacierBackend{vault: "vault", partSize: MiB, service: newFakeGlacierService(server), kv: kv}
+
+	if _, err := b.putMultipart(fn, 3*MiB/2); err == nil {
+		t.Fatal("expect the upload to fail")
+	}
+	state, found, _ := getUploadState(kv, "digest")
+	if fake.aborted || !found || len(state.Parts) != 2 {
+		t.Fatal("expect the uploaded parts to be kept: ", fake.aborted, state)
+	}
+
+	fake.completeCode, fake.completeStatus = "InvalidParameterValueException", 400
+	if _, err := b.putMultipart(fn, 3*MiB/2); err == nil {
+		t.Fatal("expect the upload to fail")
+	}
+	if _, found, _ = getUploadState(kv, "digest"); !fake.aborted || found {
+		t.Fatal("expect the rejected upload to be aborted")
+	}
+}
@@ -0,0 +1,21 @@
+module github.com/archfiery/vault
+
+go 1.20
+
+require (
+	github.com/aws/aws-sdk-go v1.55.8
+	github.com/dgraph-io/badger v0.8.1
+	golang.org/x/crypto v0.11.0
+)
+
+require (
+	github.com/AndreasBriese/bbloom v0.0.0-20190825152654-46b345b51c96 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/stretchr/testify v1.8.4 // indirect
+	golang.org/x/net v0.10.0 // indirect
+	golang.org/x/sys v0.10.0 // indirect
+	golang.org/x/term v0.10.0 // indirect
+	google.golang.org/protobuf v1.26.0 // indirect
+)
@@ -0,0 +1,209 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/dgraph-io/badger"
+)
+
+const (
+	HISTORY_PREFIX = "history" + KEY_SEP
+	VERSION_SEP    = "@" // separates a path from its version, e.g. a.txt@2
+)
+
+// date layouts accepted in a version, a date alone means the end of the day
+var versionDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+}
+
+const VERSION_DAY_LAYOUT = "2006-01-02"
+
+// HistoryEntry is a version of an alias, the digest it was added with
+type HistoryEntry struct {
+	Digest string    `json:"digest"`
+	Time   time.Time `json:"time"` // time the version was added
+}
+
+type VersionNotFoundError struct {
+	alias   string
+	version string
+}
+
+func (e *VersionNotFoundError) Error() string {
+	return fmt.Sprintf("No version %s found for alias: %s", e.version, e.alias)
+}
+
+// Get the versions of the alias, the oldest first
+// Aliases added before the history was introduced have none
+func getHistory(kv *badger.KV, alias string) ([]HistoryEntry, error) {
+	value, err := getValue(kv, []byte(HISTORY_PREFIX+alias))
+	if err != nil {
+		return nil, err
+	}
+	history := []HistoryEntry{}
+	if value == nil {
+		return history, nil
+	}
+	err = decodeRecord(value, &history)
+	if err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// Record that the alias was added with the digest
+// Nothing is recorded if the digest is the one of the latest version
+func appendHistory(kv *badger.KV, alias, digest string, t time.Time) error {
+	history, err := getHistory(kv, alias)
+	if err != nil {
+		return err
+	}
+	if len(history) > 0 && history[len(history)-1].Digest == digest {
+		return nil
+	}
+	history = append(history, HistoryEntry{Digest: digest, Time: t})
+	value, err := encodeRecord(&history)
+	if err != nil {
+		return err
+	}
+	return kv.Set([]byte(HISTORY_PREFIX+alias), value, 0)
+}
+
+// ParseVersionDate parses a date, or a date and time, of a version in local
+// time
+func ParseVersionDate(version string) (time.Time, bool) {
+	for _, layout := range versionDateLayouts {
+		t, err := time.ParseInLocation(layout, version, time.Local)
+		if err == nil {
+			return t, true
+		}
+	}
+	t, err := time.ParseInLocation(VERSION_DAY_LAYOUT, version, time.Local)
+	if err == nil {
+		return t.AddDate(0, 0, 1).Add(-time.Nanosecond), true
+	}
+	return time.Time{}, false
+}
+
+// Split PATH@VERSION into the path and the version, which is either a
+// version number, starting from 1 for the oldest one, or a date
+// An @ followed by anything else is part of the path
+func splitVersion(arg string) (string, string) {
+	i := strings.LastIndex(arg, VERSION_SEP)
+	if i < 0 {
+		return arg, ""
+	}
+	version := arg[i+len(VERSION_SEP):]
+	if _, err := strconv.Atoi(version); err == nil {
+		return arg[:i], version
+	}
+	if _, ok := ParseVersionDate(version); ok {
+		return arg[:i], version
+	}
+	return arg, ""
+}
+
+// Find the entry of the version in the history
+// A date selects the latest version added at or before it
+func findVersion(history []HistoryEntry, version string) (HistoryEntry, bool) {
+	if n, err := strconv.Atoi(version); err == nil {
+		if n < 1 || n > len(history) {
+			return HistoryEntry{}, false
+		}
+		return history[n-1], true
+	}
+	t, ok := ParseVersionDate(version)
+	if !ok {
+		return HistoryEntry{}, false
+	}
+	return versionAt(history, t)
+}
+
+// Find the latest version added at or before t
+func versionAt(history []HistoryEntry, t time.Time) (HistoryEntry, bool) {
+	for i := len(history) - 1; i >= 0; i-- {
+		if !history[i].Time.After(t) {
+			return history[i], true
+		}
+	}
+	return HistoryEntry{}, false
+}
+
+// Get the VaultFile of a version of the alias, the latest one if version is
+// empty
+// Aliases without history fall back to the alias index
+func getVaultFileVersion(kv *badger.KV, alias, version string) (VaultFile, error) {
+	history, err := getHistory(kv, alias)
+	if err != nil {
+		return VaultFile{}, err
+	}
+	if len(history) == 0 {
+		if version != "" {
+			return VaultFile{}, &VersionNotFoundError{alias: alias, version: version}
+		}
+		return getVaultFileByAlias(kv, alias)
+	}
+	entry := history[len(history)-1]
+	if version != "" {
+		var ok bool
+		entry, ok = findVersion(history, version)
+		if !ok {
+			return VaultFile{}, &VersionNotFoundError{alias: alias, version: version}
+		}
+	}
+	return getVaultFile(kv, entry.Digest)
+}
+
+// LogEntry is a version of a file with the state of its VaultFile
+type LogEntry struct {
+	HistoryEntry
+	State string // unknown if the VaultFile has no record
+}
+
+// Log gets the versions of the file, named relative to the working directory
+// as the ones given to Add, the oldest first
+func (v *Vault) Log(ctx context.Context, fn string) ([]LogEntry, error) {
+	if fn == "" {
+		return nil, &UsageError{msg: "Please specify a file"}
+	}
+	vaultDir := v.baseDirectory()
+	rel, err := resolveVaultPath(vaultDir, fn)
+	if err != nil {
+		return nil, err
+	}
+	alias := makePath(vaultDir, rel)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	kv, err := LoadBadger(makePath(vaultDir, CONF_DIR, DB))
+	if err != nil {
+		return nil, err
+	}
+	defer kv.Close()
+	history, err := getHistory(kv, alias)
+	if err != nil {
+		return nil, &DbError{op: "read", err: err}
+	}
+	if len(history) == 0 {
+		return nil, &AliasNotFoundError{alias: fn}
+	}
+	entries := []LogEntry{}
+	for _, entry := range history {
+		state := "unknown"
+		if vf, err := getVaultFile(kv, entry.Digest); err == nil {
+			state = vf.State()
+		}
+		entries = append(entries, LogEntry{HistoryEntry: entry, State: state})
+	}
+	return entries, nil
+}
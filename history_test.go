@@ -0,0 +1,66 @@
+package vault
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSplitVersion(t *testing.T) {
+	cases := []struct {
+		arg, path, version string
+	}{
+		{"a.txt", "a.txt", ""},
+		{"a.txt@2", "a.txt", "2"},
+		{"a.txt@2017-06-01", "a.txt", "2017-06-01"},
+		{"me@home.txt", "me@home.txt", ""},
+		{"me@home.txt@1", "me@home.txt", "1"},
+	}
+	for _, c := range cases {
+		path, version := splitVersion(c.arg)
+		if path != c.path || version != c.version {
+			t.Fatal("wrong split of ", c.arg, ": ", path, " ", version)
+		}
+	}
+}
+
+// Versions are selected by number or by date
+func TestHistory(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "vault")
+	defer os.RemoveAll(dir)
+	kv, _ := LoadBadger(dir)
+	defer kv.Close()
+
+	alias := "/vault/report.xlsx"
+	day1 := time.Date(2017, 6, 1, 12, 0, 0, 0, time.Local)
+	day2 := day1.AddDate(0, 0, 1)
+	insertVaultFile(kv, "1", VaultFile{Hash: "1", Aliases: []string{alias}})
+	insertVaultFile(kv, "2", VaultFile{Hash: "2", Aliases: []string{alias}})
+	appendHistory(kv, alias, "1", day1)
+	appendHistory(kv, alias, "1", day1.Add(time.Hour))
+	appendHistory(kv, alias, "2", day2)
+
+	history, err := getHistory(kv, alias)
+	if err != nil || len(history) != 2 {
+		t.Fatal("the same digest twice in a row is one version")
+	}
+	for version, digest := range map[string]string{
+		"":                 "2",
+		"1":                "1",
+		"2":                "2",
+		"2017-06-01":       "1",
+		"2017-06-02 11:00": "1",
+		"2017-06-02":       "2",
+	} {
+		vf, err := getVaultFileVersion(kv, alias, version)
+		if err != nil || vf.Hash != digest {
+			t.Fatal("wrong version ", version)
+		}
+	}
+	for _, version := range []string{"0", "3", "2017-05-31"} {
+		if _, err := getVaultFileVersion(kv, alias, version); err == nil {
+			t.Fatal("expect error for version ", version)
+		}
+	}
+}
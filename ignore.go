@@ -0,0 +1,180 @@
+package vault
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const IGNORE_FILE = ".vaultignore"
+
+// ignoreRule is a single gitignore style pattern
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool // the pattern starts with !, files matching it are included again
+	dirOnly bool // the pattern ends with /, it only matches directories
+}
+
+// Convert a gitignore style glob to a regular expression
+// * and ? do not match /, ** matches any number of directories
+// A pattern containing a / other than at its end is anchored to the vault
+// directory, otherwise it matches a name at any depth
+func globToRegexp(pattern string) (*regexp.Regexp, error) {
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	var sb strings.Builder
+	sb.WriteString("^")
+	if !anchored {
+		sb.WriteString("(.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			sb.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				sb.WriteString(regexp.QuoteMeta(string(c)))
+				continue
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
+
+func newIgnoreRule(line string) (ignoreRule, error) {
+	rule := ignoreRule{}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+	re, err := globToRegexp(line)
+	if err != nil {
+		return ignoreRule{}, err
+	}
+	rule.re = re
+	return rule, nil
+}
+
+// Matcher decides which files under the vault directory are added when a
+// directory is walked
+// Paths are relative to the vault directory, separated by /
+type Matcher struct {
+	ignores  []ignoreRule // rules of the .vaultignore file, the last match wins
+	includes []ignoreRule // if not empty, files must match one of them
+	excludes []ignoreRule // files matching any of them are skipped
+}
+
+func compileRules(patterns []string) ([]ignoreRule, error) {
+	rules := []ignoreRule{}
+	for _, pattern := range patterns {
+		rule, err := newIgnoreRule(pattern)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// NewMatcher creates a matcher from the lines of an ignore file and the
+// include and exclude patterns
+func NewMatcher(ignores, includes, excludes []string) (*Matcher, error) {
+	m := &Matcher{}
+	var err error
+	if m.ignores, err = compileRules(ignores); err != nil {
+		return nil, err
+	}
+	if m.includes, err = compileRules(includes); err != nil {
+		return nil, err
+	}
+	if m.excludes, err = compileRules(excludes); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Read the patterns of an ignore file, skipping blank lines and comments
+// A missing file has no patterns
+func readIgnoreFile(fn string) ([]string, error) {
+	file, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	patterns := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, scanner.Err()
+}
+
+func matchAny(rules []ignoreRule, path string, isDir bool) bool {
+	for _, rule := range rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Ignored reports whether the path is ignored by the .vaultignore rules
+func (m *Matcher) Ignored(path string, isDir bool) bool {
+	ignored := false
+	for _, rule := range m.ignores {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.re.MatchString(path) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// SkipDir reports whether the directory at path is not walked at all
+func (m *Matcher) SkipDir(path string) bool {
+	return m.Ignored(path, true) || matchAny(m.excludes, path, true)
+}
+
+// Match reports whether the file at path is added
+func (m *Matcher) Match(path string) bool {
+	if m.Ignored(path, false) || matchAny(m.excludes, path, false) {
+		return false
+	}
+	return len(m.includes) == 0 || matchAny(m.includes, path, false)
+}
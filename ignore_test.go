@@ -0,0 +1,45 @@
+package vault
+
+import (
+	"testing"
+)
+
+func TestMatcher(t *testing.T) {
+	ignores := []string{"*.tmp", "/build", "cache/", "photos/**/*.raw", "!keep.tmp"}
+	m, err := NewMatcher(ignores, []string{}, []string{})
+	if err != nil {
+		t.Fatal("error creating matcher: ", err.Error())
+	}
+	cases := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"a.tmp", false, true},
+		{"docs/a.tmp", false, true},
+		{"docs/keep.tmp", false, false},
+		{"build", true, true},
+		{"src/build", true, false},
+		{"cache", true, true},
+		{"cache", false, false},
+		{"photos/raw.raw", false, true},
+		{"photos/2017/01/a.raw", false, true},
+		{"music/a.raw", false, false},
+		{"photos/a.jpg", false, false},
+	}
+	for _, c := range cases {
+		if m.Ignored(c.path, c.isDir) != c.ignored {
+			t.Fatal("wrong ignore result for ", c.path)
+		}
+	}
+}
+
+func TestMatcherIncludeExclude(t *testing.T) {
+	m, _ := NewMatcher([]string{}, []string{"*.jpg", "*.png"}, []string{"thumbs/"})
+	if !m.Match("photos/a.jpg") || m.Match("photos/a.txt") {
+		t.Fatal("wrong include result")
+	}
+	if !m.SkipDir("photos/thumbs") || m.SkipDir("photos") {
+		t.Fatal("wrong exclude result")
+	}
+}
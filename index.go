@@ -0,0 +1,108 @@
+package vault
+
+import (
+	"context"
+)
+
+import (
+	"github.com/dgraph-io/badger"
+)
+
+// The alias index maps every alias to the digest it was last added with, so
+// that a path is looked up without scanning every VaultFile record
+// Its records are stored under alias:PATH with the digest as their value
+
+// Get the digest the alias is indexed to
+// Return false if the alias is not indexed
+func getAliasDigest(kv *badger.KV, alias string) (string, bool, error) {
+	value, err := getValue(kv, []byte(ALIAS_PREFIX+alias))
+	if err != nil {
+		return "", false, err
+	}
+	if value == nil {
+		return "", false, nil
+	}
+	return string(value), true, nil
+}
+
+// Call f for every indexed alias starting with prefix, in path order
+func forEachAlias(kv *badger.KV, prefix string, f func(alias, digest string) error) error {
+	return forEachWithPrefix(kv, ALIAS_PREFIX+prefix, func(key string, value []byte) error {
+		return f(prefix+key, string(value))
+	})
+}
+
+// Compute the entries rebuilding the alias index from the VaultFile records
+// and the history
+// An alias is indexed to its latest version, or if it has no history, to the
+// first VaultFile having it in key order
+// Return the entries and the number of indexed aliases
+func aliasIndexEntries(kv *badger.KV) ([]*badger.Entry, int, error) {
+	index := make(map[string]string)
+	err := forEachVaultFile(kv, func(key string, vf VaultFile) {
+		for _, alias := range vf.Aliases {
+			if _, ok := index[alias]; !ok {
+				index[alias] = key
+			}
+		}
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	for alias := range index {
+		history, err := getHistory(kv, alias)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(history) == 0 {
+			continue
+		}
+		latest := history[len(history)-1].Digest
+		if _, err := getVaultFile(kv, latest); err == nil {
+			index[alias] = latest
+		}
+	}
+
+	entries := []*badger.Entry{}
+	err = forEachAlias(kv, "", func(alias, digest string) error {
+		if _, ok := index[alias]; !ok {
+			entries = badger.EntriesDelete(entries, []byte(ALIAS_PREFIX+alias))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	for alias, digest := range index {
+		entries = badger.EntriesSet(entries, []byte(ALIAS_PREFIX+alias), []byte(digest))
+	}
+	return entries, len(index), nil
+}
+
+// Rebuild the alias index
+// Return the number of indexed aliases
+func rebuildAliasIndex(kv *badger.KV) (int, error) {
+	entries, n, err := aliasIndexEntries(kv)
+	if err != nil || len(entries) == 0 {
+		return n, err
+	}
+	return n, writeBatch(kv, entries)
+}
+
+// Reindex rebuilds the alias index of the vault
+// Return the number of indexed aliases
+func (v *Vault) Reindex(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	kv, err := LoadBadger(makePath(v.baseDirectory(), CONF_DIR, DB))
+	if err != nil {
+		return 0, err
+	}
+	defer kv.Close()
+	n, err := rebuildAliasIndex(kv)
+	if err != nil {
+		return n, &DbError{op: "reindex", err: err}
+	}
+	return n, nil
+}
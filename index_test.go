@@ -0,0 +1,48 @@
+package vault
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// Aliases are indexed on insert, and the index is rebuilt from the records
+func TestAliasIndex(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "vault")
+	defer os.RemoveAll(dir)
+	kv, _ := LoadBadger(dir)
+	defer kv.Close()
+
+	insertVaultFile(kv, "1", VaultFile{Hash: "1", Aliases: []string{"/vault/a", "/vault/b"}})
+	insertVaultFile(kv, "2", VaultFile{Hash: "2", Aliases: []string{"/vault/a"}})
+	if vf, err := getVaultFileByAlias(kv, "/vault/a"); err != nil || vf.Hash != "1" {
+		t.Fatal("an indexed alias is not moved by another record")
+	}
+	insertVaultFile(kv, "2", VaultFile{Hash: "2", Aliases: []string{"/vault/a"}}, "/vault/a")
+	if vf, err := getVaultFileByAlias(kv, "/vault/a"); err != nil || vf.Hash != "2" {
+		t.Fatal("an added alias should be indexed to the record")
+	}
+	if _, err := getVaultFileByAlias(kv, "/vault/c"); err == nil {
+		t.Fatal("expect error for an unknown alias")
+	}
+
+	// a database written before the index
+	kv.Delete([]byte(ALIAS_PREFIX + "/vault/a"))
+	kv.Delete([]byte(ALIAS_PREFIX + "/vault/b"))
+	kv.Set([]byte(ALIAS_PREFIX+"/vault/gone"), []byte("3"), 0)
+	appendHistory(kv, "/vault/a", "2", time.Now())
+	n, err := rebuildAliasIndex(kv)
+	if err != nil || n != 2 {
+		t.Fatal("wrong number of indexed aliases: ", n)
+	}
+	if vf, err := getVaultFileByAlias(kv, "/vault/a"); err != nil || vf.Hash != "2" {
+		t.Fatal("an alias should be indexed to its latest version")
+	}
+	if vf, err := getVaultFileByAlias(kv, "/vault/b"); err != nil || vf.Hash != "1" {
+		t.Fatal("wrong index for an alias without history")
+	}
+	if _, found, _ := getAliasDigest(kv, "/vault/gone"); found {
+		t.Fatal("stale aliases should be removed")
+	}
+}
@@ -0,0 +1,103 @@
+package vault
+
+import (
+	"context"
+	"strings"
+)
+
+const (
+	STATE_ALL     = "all"
+	STATE_PUSHED  = "pushed"
+	STATE_CACHED  = "cached"
+	STATE_MISSING = "missing"
+)
+
+// ListOptions select the VaultFile records listed, empty fields match
+// everything
+type ListOptions struct {
+	Prefix string // path prefix relative to the vault directory
+	State  string // one of all, pushed, cached and missing
+	KeyId  string // openpgp key id of one of the recipients
+}
+
+// listFilter selects the VaultFile records listed
+// Empty fields match everything
+type listFilter struct {
+	prefix string // alias prefix, the full path including the vault directory
+	state  string // one of all, pushed, cached and missing
+	keyId  string // openpgp key id of one of the recipients
+}
+
+func newListFilter(vaultDir string, opts ListOptions) (listFilter, error) {
+	filter := listFilter{
+		state: opts.State,
+		keyId: opts.KeyId,
+	}
+	if opts.Prefix != "" {
+		filter.prefix = makePath(vaultDir, opts.Prefix)
+	}
+	switch filter.state {
+	case "", STATE_ALL, STATE_PUSHED, STATE_CACHED, STATE_MISSING:
+	default:
+		return listFilter{}, &UsageError{msg: "state must be one of all, pushed, cached and missing"}
+	}
+	return filter, nil
+}
+
+// State tells whether the VaultFile is pushed to the remote or only cached
+// locally
+// A pushed file is missing if the remote inventory does not have it
+func (vf VaultFile) State() string {
+	if vf.Locator == "" {
+		return STATE_CACHED
+	}
+	if vf.Missing {
+		return STATE_MISSING
+	}
+	return STATE_PUSHED
+}
+
+func (f listFilter) match(vf VaultFile) bool {
+	if f.state != "" && f.state != STATE_ALL && f.state != vf.State() {
+		return false
+	}
+	if f.keyId != "" && !containsKeyId(vf.KeyIds, f.keyId) {
+		return false
+	}
+	if f.prefix == "" {
+		return true
+	}
+	for _, alias := range vf.Aliases {
+		if strings.HasPrefix(alias, f.prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// List the VaultFile records selected by the options, in key order
+func (v *Vault) List(ctx context.Context, opts ListOptions) ([]VaultFile, error) {
+	vaultDir := v.baseDirectory()
+	filter, err := newListFilter(vaultDir, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	kv, err := LoadBadger(makePath(vaultDir, CONF_DIR, DB))
+	if err != nil {
+		return nil, err
+	}
+	defer kv.Close()
+	files := []VaultFile{}
+	err = forEachVaultFile(kv, func(key string, vf VaultFile) {
+		if filter.match(vf) {
+			files = append(files, vf)
+		}
+	})
+	if err != nil {
+		return nil, &DbError{op: "read", err: err}
+	}
+	return files, nil
+}
@@ -0,0 +1,33 @@
+package vault
+
+import (
+	"testing"
+)
+
+func TestListFilter(t *testing.T) {
+	cached := VaultFile{
+		Hash:    "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03",
+		Aliases: []string{"/vault/photos/a.jpg", "/vault/b.jpg"},
+		KeyIds:  []string{"C21B7817", "B2E225E7"},
+	}
+	pushed := cached
+	pushed.Backend = BACKEND_GLACIER
+	pushed.Locator = "glacier-id"
+
+	if !(listFilter{}).match(cached) {
+		t.Fatal("empty filter should match everything")
+	}
+	if (listFilter{state: STATE_PUSHED}).match(cached) || !(listFilter{state: STATE_PUSHED}).match(pushed) {
+		t.Fatal("wrong pushed state filter")
+	}
+	if !(listFilter{state: STATE_CACHED}).match(cached) || (listFilter{state: STATE_CACHED}).match(pushed) {
+		t.Fatal("wrong cached state filter")
+	}
+	if !(listFilter{keyId: "c21b7817"}).match(cached) || !(listFilter{keyId: "B2E225E7"}).match(cached) ||
+		(listFilter{keyId: "0B1E4A2C"}).match(cached) {
+		t.Fatal("wrong key id filter")
+	}
+	if !(listFilter{prefix: "/vault/photos"}).match(cached) || (listFilter{prefix: "/vault/music"}).match(cached) {
+		t.Fatal("wrong prefix filter")
+	}
+}
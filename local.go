@@ -0,0 +1,110 @@
+package vault
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	BACKEND_FILE = "file"
+	PARTIAL_EXT  = ".partial" // extension of the objects being copied
+)
+
+// Copy the file src to dst
+// The data is written to a partial file first, and renamed to dst once it is
+// synced, so that dst is either complete or absent
+func copyFile(src, dst string) error {
+	reader, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	partial := dst + PARTIAL_EXT
+	writer, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, reader)
+	if err == nil {
+		err = writer.Sync()
+	}
+	if cerr := writer.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(partial)
+		return err
+	}
+	return os.Rename(partial, dst)
+}
+
+// LocalBackend stores the cache objects in a local directory, such as a NAS
+// mount or an USB drive
+// The locator is the object file name relative to the directory, so the
+// directory can be mounted elsewhere later
+type LocalBackend struct {
+	dir string
+}
+
+func NewLocalBackend(dir string) (*LocalBackend, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: os.ErrInvalid}
+	}
+	return &LocalBackend{dir: dir}, nil
+}
+
+func (b *LocalBackend) Name() string {
+	return BACKEND_FILE
+}
+
+func (b *LocalBackend) Target() string {
+	return b.dir
+}
+
+// Put copies the file into the directory under its name, the digest
+func (b *LocalBackend) Put(fn string) (string, error) {
+	locator := filepath.Base(fn)
+	err := copyFile(fn, filepath.Join(b.dir, locator))
+	if err != nil {
+		return "", err
+	}
+	return locator, nil
+}
+
+func (b *LocalBackend) Get(ctx context.Context, locator, ofn string) error {
+	return copyFile(filepath.Join(b.dir, locator), ofn)
+}
+
+func (b *LocalBackend) Delete(locator string) error {
+	return os.Remove(filepath.Join(b.dir, locator))
+}
+
+// List returns every object file in the directory
+func (b *LocalBackend) List(ctx context.Context) ([]RemoteObject, time.Time, error) {
+	date := time.Now()
+	files, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	objects := []RemoteObject{}
+	for _, fi := range files {
+		if fi.IsDir() || strings.HasSuffix(fi.Name(), PARTIAL_EXT) {
+			continue
+		}
+		objects = append(objects, RemoteObject{
+			Locator:     fi.Name(),
+			Description: filepath.Join(b.dir, fi.Name()),
+			Size:        fi.Size(),
+		})
+	}
+	return objects, date, nil
+}
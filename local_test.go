@@ -0,0 +1,55 @@
+package vault
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Put a file to a local backend, list it, get it back and delete it
+func TestLocalBackend(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "vault")
+	defer os.RemoveAll(dir)
+	backend, err := NewLocalBackend(dir)
+	if err != nil {
+		t.Fatal("error creating backend: ", err.Error())
+	}
+
+	locator, err := backend.Put("test_files/test_file")
+	if err != nil || locator != "test_file" {
+		t.Fatal("error putting file: ", locator, err)
+	}
+	objects, date, err := backend.List(context.Background())
+	if err != nil || len(objects) != 1 || objects[0].Locator != locator || date.IsZero() {
+		t.Fatal("wrong listing: ", objects, err)
+	}
+
+	ofn := dir + "/fetched"
+	err = backend.Get(context.Background(), locator, ofn)
+	if err != nil {
+		t.Fatal("error getting file: ", err.Error())
+	}
+	orig, _ := ioutil.ReadFile("test_files/test_file")
+	fetched, _ := ioutil.ReadFile(ofn)
+	if string(orig) != string(fetched) {
+		t.Fatal("fetched file differs from the original")
+	}
+	os.Remove(ofn)
+
+	err = backend.Delete(locator)
+	if err != nil {
+		t.Fatal("error deleting file: ", err.Error())
+	}
+	objects, _, _ = backend.List(context.Background())
+	if len(objects) != 0 {
+		t.Fatal("object should be deleted")
+	}
+}
+
+func TestLocalBackendMissingDir(t *testing.T) {
+	_, err := NewLocalBackend("test_files/no_such_dir")
+	if err == nil {
+		t.Fatal("expect error here")
+	}
+}
@@ -0,0 +1,131 @@
+package vault
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strconv"
+)
+
+import (
+	"github.com/dgraph-io/badger"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// A vault encrypts its files either to the public keys of the GnuPG keyring,
+// or with a passphrase only, the mode is chosen at init and recorded in the
+// catalog under vault:mode
+// Catalogs written before the modes were introduced have no mode record and
+// are public key vaults
+const (
+	MODE_PUBKEY    = "pubkey"
+	MODE_SYMMETRIC = "symmetric"
+	MODE_KEY       = "vault" + KEY_SEP + "mode"
+)
+
+// The number of times the passphrase is hashed into the key of a symmetric
+// vault, openpgp cannot represent the counts outside of this range
+const (
+	DEFAULT_S2K_COUNT = 65536
+	MIN_S2K_COUNT     = 1024
+	MAX_S2K_COUNT     = 65011712
+)
+
+// The content encrypted with the passphrase of a symmetric vault to check the
+// passphrase before a file is encrypted with a mistyped one
+const passphraseCheck = "vault"
+
+// InitOptions choose how the files of a new vault are encrypted
+type InitOptions struct {
+	Mode     string // MODE_PUBKEY or MODE_SYMMETRIC, MODE_PUBKEY if empty
+	S2KCount int    // passphrase hash count of a symmetric vault, the default if 0
+}
+
+// vaultMode is the mode record of the catalog
+type vaultMode struct {
+	Mode  string `json:"mode"`
+	Check []byte `json:"check,omitempty"` // passphraseCheck encrypted with the passphrase
+}
+
+// Get the mode record of the catalog, a public key vault if it has none
+func getVaultMode(kv *badger.KV) (vaultMode, error) {
+	value, err := getValue(kv, []byte(MODE_KEY))
+	if err != nil {
+		return vaultMode{}, &DbError{op: "read", err: err}
+	}
+	if value == nil {
+		return vaultMode{Mode: MODE_PUBKEY}, nil
+	}
+	mode := vaultMode{}
+	err = decodeRecord(value, &mode)
+	if err != nil {
+		return vaultMode{}, &DbError{op: "read", err: err}
+	}
+	return mode, nil
+}
+
+// Save the mode record in the catalog
+func putVaultMode(kv *badger.KV, mode vaultMode) error {
+	value, err := encodeRecord(&mode)
+	if err != nil {
+		return err
+	}
+	err = kv.Set([]byte(MODE_KEY), value, 0)
+	if err != nil {
+		return &DbError{op: "write", err: err}
+	}
+	return nil
+}
+
+// Parse the s2kcount config value
+// Return the default count if the value is empty
+func parseS2KCount(value string) (int, error) {
+	if value == "" {
+		return DEFAULT_S2K_COUNT, nil
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil || count < MIN_S2K_COUNT || count > MAX_S2K_COUNT {
+		return 0, &ConfigError{key: "s2kcount", value: value}
+	}
+	return count, nil
+}
+
+// Encrypt the passphrase check with the passphrase
+func newPassphraseCheck(passphrase []byte, s2kCount int) ([]byte, error) {
+	var buf bytes.Buffer
+	wc, err := openpgp.SymmetricallyEncrypt(&buf, passphrase, nil, &packet.Config{S2KCount: s2kCount})
+	if err != nil {
+		return nil, err
+	}
+	_, err = wc.Write([]byte(passphraseCheck))
+	if err != nil {
+		return nil, err
+	}
+	err = wc.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decrypt the passphrase check of the mode record with the passphrase
+// Return WrongPassphraseError if it is not the passphrase of the vault
+func (m vaultMode) checkPassphrase(passphrase []byte) error {
+	asked := false
+	prompt := func(keys []openpgp.Key, symm bool) ([]byte, error) {
+		if asked {
+			return nil, &WrongPassphraseError{}
+		}
+		asked = true
+		return passphrase, nil
+	}
+	md, err := openpgp.ReadMessage(bytes.NewReader(m.Check), openpgp.EntityList{}, prompt, nil)
+	if err != nil {
+		return &WrongPassphraseError{}
+	}
+	content, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil || string(content) != passphraseCheck {
+		return &WrongPassphraseError{}
+	}
+	return nil
+}
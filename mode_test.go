@@ -0,0 +1,88 @@
+package vault
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func newSymLocalContextForTest(passphrase string) LocalContext {
+	v := Vault{directory: "test_files"}
+	pgp := PrivatePgpInfo{passphrase: []byte(passphrase)}
+	return LocalContext{vault: &v, pgp: pgp, mode: MODE_SYMMETRIC, s2kCount: MIN_S2K_COUNT}
+}
+
+// A symmetric vault records its mode and checks its passphrase
+func TestInitSymmetric(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "vault")
+	defer os.RemoveAll(dir)
+	secret := func() ([]byte, error) { return []byte("secret"), nil }
+	if _, err := Init(dir, nil, InitOptions{Mode: MODE_SYMMETRIC}); err == nil {
+		t.Fatal("a symmetric vault needs a passphrase")
+	}
+	if _, err := Init(dir, secret, InitOptions{Mode: MODE_SYMMETRIC, S2KCount: 10}); err == nil {
+		t.Fatal("the s2k count is out of range")
+	}
+	v, err := Init(dir, secret, InitOptions{Mode: MODE_SYMMETRIC, S2KCount: MIN_S2K_COUNT})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	kv, err := LoadBadger(makePath(dir, CONF_DIR, DB))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer kv.Close()
+	lc, err := NewLocalContext(v, kv, false)
+	if err != nil || !lc.symmetric() || lc.s2kCount != MIN_S2K_COUNT || len(lc.recipientIds()) != 0 {
+		t.Fatal("expect a symmetric context: ", lc, err)
+	}
+	wrong := &Vault{directory: v.Dir(), passphrase: testPassphrase}
+	_, err = NewLocalContext(wrong, kv, true)
+	if _, ok := err.(*WrongPassphraseError); !ok {
+		t.Fatal("expect a wrong passphrase: ", err)
+	}
+
+	// the passphrase is not asked for an existing vault
+	asked := func() ([]byte, error) {
+		t.Fatal("the passphrase should not be asked")
+		return nil, nil
+	}
+	_, err = Init(dir, asked, InitOptions{Mode: MODE_SYMMETRIC})
+	if _, ok := err.(*UsageError); !ok {
+		t.Fatal("expect the vault to exist: ", err)
+	}
+}
+
+// Files of a symmetric vault are decrypted with the passphrase only
+func TestEncryptSymmetric(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "vault")
+	defer os.RemoveAll(dir)
+	lc := newSymLocalContextForTest("secret")
+	digest, encryptedFn, err := EncryptFile(&lc, "test_files/hello", dir, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected, _ := localTreeHash("test_files/hello")
+	if digest != expected {
+		t.Fatal("wrong digest of the plaintext")
+	}
+
+	prompt, _ := promptFromContext(&lc)
+	decryptedFn, err := DecryptFile(encryptedFn, dir, nil, prompt)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	content, _ := ioutil.ReadFile(decryptedFn)
+	hello, _ := ioutil.ReadFile("test_files/hello")
+	if string(content) != string(hello) {
+		t.Fatal("wrong decrypted content")
+	}
+
+	other := newSymLocalContextForTest("other")
+	prompt, _ = promptFromContext(&other)
+	_, err = DecryptTreeHash(encryptedFn, nil, prompt)
+	if _, ok := err.(*WrongPassphraseError); !ok {
+		t.Fatal("expect a wrong passphrase: ", err)
+	}
+}
@@ -1,43 +1,176 @@
-package main
+package vault
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
+	"sync"
 )
 
-func updateKV(vaultDir, key, glacierId string) error {
-	dbPath := makePath(vaultDir, CONF_DIR, DB)
-	kv := LoadBadger(dbPath)
-	return updateVaultFileWithDigest(kv, key, glacierId)
+import (
+	"github.com/dgraph-io/badger"
+)
+
+// UntrackedObjectError is returned when an object is uploaded, but neither
+// recorded in the data store nor removed from the backend again
+type UntrackedObjectError struct {
+	locator string
+	err     error // why the object was not recorded
+	derr    error // why the object was not removed
+}
+
+func (e *UntrackedObjectError) Error() string {
+	return fmt.Sprintf("uploaded as %s but not recorded: %s, and not deleted: %s", e.locator, e.err.Error(), e.derr.Error())
+}
+
+func (e *UntrackedObjectError) Unwrap() []error {
+	return []error{e.err, e.derr}
+}
+
+// PushOptions tune a push
+type PushOptions struct {
+	Jobs     int       // number of files uploaded at once
+	Progress io.Writer // progress messages are written to it, nil for none
+}
+
+// PushResult is the outcome of a push
+type PushResult struct {
+	Total    int           // number of cache files to push
+	Failures []FileFailure // the cache files that failed, named by digest
+}
+
+// Push a single cache file to the backend, retrying transient failures
+// The cache file is removed only after the data store records its locator
+// If the locator cannot be recorded, the object is removed from the backend
+func pushFile(kv *badger.KV, backend Backend, cacheDir, name string) error {
+	fn := makePath(cacheDir, name)
+	var locator string
+	err := withRetry(func() error {
+		var err error
+		locator, err = backend.Put(fn)
+		return err
+	})
+	if err != nil {
+		return &RemoteError{op: "put", err: err}
+	}
+	storageClass := ""
+	if cb, ok := backend.(classedBackend); ok {
+		storageClass = cb.StorageClass()
+	}
+	err = updateVaultFileWithDigest(kv, name, backend.Name(), backend.Target(), locator, storageClass)
+	if err != nil {
+		derr := withRetry(func() error {
+			return backend.Delete(locator)
+		})
+		if derr != nil {
+			return &UntrackedObjectError{locator: locator, err: err, derr: derr}
+		}
+		return err
+	}
+	return os.Remove(fn)
+}
+
+// Whether the name is a tree hash in hex, the name of a cache file
+func isDigest(name string) bool {
+	_, err := hex.DecodeString(name)
+	return err == nil && len(name) == 2*sha256.Size
+}
+
+// List the cache files, skipping the ones still being written and anything
+// else that is not named by its digest
+func readCacheDir(cacheDir string) ([]os.FileInfo, error) {
+	all, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+	files := []os.FileInfo{}
+	for _, fi := range all {
+		if fi.IsDir() || !isDigest(fi.Name()) {
+			continue
+		}
+		files = append(files, fi)
+	}
+	return files, nil
 }
 
-func pushFiles(ctx *AWSContext) {
-	vaultDir := ctx.baseDirectory()
-	setAwsEnv(vaultDir)
+// Push the cache files to the backend with a pool of workers
+// No more file is started once the context is done, the ones left stay in the
+// cache
+// Return FailuresError if some files failed to be pushed
+func (v *Vault) Push(ctx context.Context, opts PushOptions) (PushResult, error) {
+	result := PushResult{Failures: []FileFailure{}}
+	if opts.Jobs < 1 {
+		return result, &UsageError{msg: "jobs must be at least 1"}
+	}
+	awsCtx, err := NewAWSContext(v)
+	if err != nil {
+		return result, err
+	}
+	vaultDir := v.baseDirectory()
 	cacheFilePath := makePath(vaultDir, CONF_DIR, CACHE)
-	svc := NewService(ctx.awsRegion())
-	files, err := ioutil.ReadDir(cacheFilePath)
+	backendOpts := DefaultBackendOptions()
+	backendOpts.Progress = opts.Progress
+	backend, err := NewBackend(&awsCtx, backendOpts)
 	if err != nil {
-		log.Fatal("error access cache directory")
+		return result, err
 	}
-	if len(files) == 0 {
-		fmt.Println("Nothing to push")
-	} else {
-		fmt.Println("Start pushing")
+	kv, err := LoadBadger(makePath(vaultDir, CONF_DIR, DB))
+	if err != nil {
+		return result, err
 	}
-	for _, fi := range files {
-		fn := makePath(cacheFilePath, fi.Name())
-		output, err := UploadFile(fn, ctx.remote(), svc)
+	defer kv.Close()
+	if rb, ok := backend.(resumableBackend); ok {
+		rb.resumeWith(kv)
+		err = rb.cleanUploads(cacheFilePath)
 		if err != nil {
-			continue // silently fail
+			progressf(opts.Progress, "Fail to clean up in-flight uploads: %s\n", err.Error())
 		}
-		glacierId := output.ArchiveId
-		err = updateKV(vaultDir, fi.Name(), *glacierId)
-		if err != nil {
-			continue // silently fail
+	}
+	files, err := readCacheDir(cacheFilePath)
+	if err != nil {
+		return result, fmt.Errorf("error access cache directory: %w", err)
+	}
+	result.Total = len(files)
+	if len(files) == 0 {
+		progressf(opts.Progress, "Nothing to push\n")
+		return result, nil
+	}
+	progressf(opts.Progress, "Start pushing\n")
+
+	names := make(chan string)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				err := pushFile(kv, backend, cacheFilePath, name)
+				if err != nil {
+					lock.Lock()
+					result.Failures = append(result.Failures, FileFailure{Path: name, Err: err})
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	for _, fi := range files {
+		if ctx.Err() != nil {
+			break
 		}
-		os.Remove(fn)
+		names <- fi.Name()
+	}
+	close(names)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+	if len(result.Failures) > 0 {
+		return result, &FailuresError{count: len(result.Failures), what: "files failed to push"}
 	}
+	return result, nil
 }
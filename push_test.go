@@ -0,0 +1,80 @@
+package vault
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+// Push cache files to a local backend from several goroutines
+func TestPushFileConcurrently(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "vault")
+	defer os.RemoveAll(cacheDir)
+	remoteDir, _ := ioutil.TempDir("", "vault")
+	defer os.RemoveAll(remoteDir)
+	dbDir, _ := ioutil.TempDir("", "vault")
+	defer os.RemoveAll(dbDir)
+	kv, _ := LoadBadger(dbDir)
+	defer kv.Close()
+	backend, _ := NewLocalBackend(remoteDir)
+
+	names := []string{}
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("digest%d", i)
+		ioutil.WriteFile(makePath(cacheDir, name), []byte(name), 0664)
+		insertVaultFile(kv, name, VaultFile{Hash: name})
+		names = append(names, name)
+	}
+
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if err := pushFile(kv, backend, cacheDir, name); err != nil {
+				t.Error("error pushing ", name, ": ", err.Error())
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	for _, name := range names {
+		vf, err := getVaultFile(kv, name)
+		if err != nil || vf.Backend != BACKEND_FILE || vf.Locator != name {
+			t.Fatal("wrong record for ", name)
+		}
+		if dirExists(makePath(cacheDir, name)) {
+			t.Fatal("cache file should be removed after push: ", name)
+		}
+	}
+}
+
+// Only the files named by their digest are pushed from the cache
+func TestReadCacheDir(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "vault")
+	defer os.RemoveAll(cacheDir)
+	digest := "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"
+	for _, name := range []string{digest, digest + PARTIAL_EXT, digest + ".decrypt", "notes.txt"} {
+		ioutil.WriteFile(makePath(cacheDir, name), []byte("data"), 0644)
+	}
+	files, err := readCacheDir(cacheDir)
+	if err != nil || len(files) != 1 || files[0].Name() != digest {
+		t.Fatal("expect the digest file only: ", files, err)
+	}
+}
+
+// An untracked object reports why it was neither recorded nor deleted
+func TestUntrackedObjectError(t *testing.T) {
+	err := errors.New("db closed")
+	derr := errors.New("access denied")
+	var e error = &UntrackedObjectError{locator: "archive", err: err, derr: derr}
+	if !errors.Is(e, err) || !errors.Is(e, derr) {
+		t.Fatal("expect both errors to be wrapped")
+	}
+	if e.Error() != "uploaded as archive but not recorded: db closed, and not deleted: access denied" {
+		t.Fatal("wrong message: ", e.Error())
+	}
+}
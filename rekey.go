@@ -0,0 +1,366 @@
+package vault
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/dgraph-io/badger"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// Old archives still to be deleted by rekey are stored under
+// rekey:DIGEST:LOCATOR, so that a file rekeyed again before the deletion keeps
+// every old archive recorded
+const REKEY_PREFIX = "rekey" + KEY_SEP
+
+// Return the key recording the old archive of the digest to be deleted
+func rekeyKey(digest, locator string) []byte {
+	return []byte(REKEY_PREFIX + digest + KEY_SEP + locator)
+}
+
+// RekeyOptions select the files re-encrypted to the current recipients
+// Empty fields match everything
+type RekeyOptions struct {
+	Prefix   string // path prefix relative to the vault directory
+	KeyId    string // only the files encrypted to this key id
+	Delete   bool   // delete the old archive once the new one is recorded
+	Batch    int    // number of archives retrieved at once
+	Backend  BackendOptions
+	Progress io.Writer // progress messages are written to it, nil for none
+}
+
+// RekeyResult is the outcome of a rekey
+type RekeyResult struct {
+	Rekeyed  int           // files re-encrypted
+	Skipped  int           // files already encrypted to the recipients
+	Failures []FileFailure // files that failed, named by digest
+}
+
+// rekeyState is an old archive to delete, recorded along with the new one so
+// that a deletion that fails is retried by the next rekey
+type rekeyState struct {
+	Backend string `json:"backend"`
+	Remote  string `json:"remote,omitempty"` // target of the backend, empty on older records
+	Locator string `json:"locator"`
+}
+
+// Whether both lists have the same key ids, ignoring the order and the case
+func sameKeyIds(a, b []string) bool {
+	for _, keyId := range a {
+		if !containsKeyId(b, keyId) {
+			return false
+		}
+	}
+	for _, keyId := range b {
+		if !containsKeyId(a, keyId) {
+			return false
+		}
+	}
+	return true
+}
+
+// Select the VaultFile records matching the filter which are not encrypted to
+// the key ids yet
+// Return them in key order, and the number of matching records already
+// encrypted to the key ids
+func rekeySet(kv *badger.KV, filter listFilter, keyIds []string) ([]VaultFile, int, error) {
+	files := []VaultFile{}
+	skipped := 0
+	err := forEachVaultFile(kv, func(key string, vf VaultFile) {
+		if !filter.match(vf) {
+			return
+		}
+		if sameKeyIds(vf.KeyIds, keyIds) {
+			skipped++
+			return
+		}
+		files = append(files, vf)
+	})
+	return files, skipped, err
+}
+
+// Decrypt the encrypted file of vf and encrypt it again to the recipients of
+// the context, both into dir
+// Return the path of the new encrypted file
+func reencryptFile(lc *LocalContext, encryptedFn, dir string, vf VaultFile, prompt openpgp.PromptFunction) (string, error) {
+	decryptedFn, err := DecryptFile(encryptedFn, dir, &packet.Config{}, prompt)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(decryptedFn)
+	config := &packet.Config{
+		DefaultCompressionAlgo: 1,
+		CompressionConfig:      &packet.CompressionConfig{Level: 5},
+	}
+	digest, path, err := EncryptFile(lc, decryptedFn, dir, config)
+	if err != nil {
+		return "", err
+	}
+	if digest != vf.Hash {
+		os.Remove(path)
+		return "", &ChecksumMismatchError{expected: vf.Hash, actual: digest}
+	}
+	return path, nil
+}
+
+// Record the new encryption of the file with digest key, along with extra
+// entries in the same batch
+// The record is read again, as aliases may have been added meanwhile
+func updateRekeyed(kv *badger.KV, key string, keyIds []string, cipherSize int64,
+	update func(vf *VaultFile), extra []*badger.Entry) error {
+	vaultFileLock.Lock()
+	defer vaultFileLock.Unlock()
+	vf, err := getVaultFile(kv, key)
+	if err != nil {
+		return err
+	}
+	vf.KeyIds = keyIds
+	vf.CipherSize = cipherSize
+	update(&vf)
+	value, err := encodeRecord(&vf)
+	if err != nil {
+		return err
+	}
+	entries := badger.EntriesSet(extra, []byte(key), value)
+	err = writeBatch(kv, entries)
+	if err != nil {
+		return &DbError{op: "write", err: err}
+	}
+	return nil
+}
+
+// Re-encrypt a file that is only cached, replacing its cache file
+func rekeyCached(lc *LocalContext, kv *badger.KV, cacheDir, rekeyDir string, vf VaultFile,
+	prompt openpgp.PromptFunction) error {
+	fn := makePath(cacheDir, vf.Hash)
+	if !dirExists(fn) {
+		return &NotPushedError{alias: vf.Hash}
+	}
+	path, err := reencryptFile(lc, fn, rekeyDir, vf, prompt)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path, fn)
+	if err != nil {
+		return err
+	}
+	return updateRekeyed(kv, vf.Hash, lc.recipientIds(), fi.Size(), func(vf *VaultFile) {}, nil)
+}
+
+// Re-encrypt a pushed file from its retrieved archive, upload the new archive
+// and record it
+// With remove, the old archive is recorded to be deleted, unless the backend
+// stored the new one in its place
+func rekeyPushed(lc *LocalContext, kv *badger.KV, backend Backend, encryptedFn, rekeyDir string,
+	vf VaultFile, prompt openpgp.PromptFunction, remove bool) error {
+	path, err := reencryptFile(lc, encryptedFn, rekeyDir, vf, prompt)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	var locator string
+	err = withRetry(func() error {
+		var err error
+		locator, err = backend.Put(path)
+		return err
+	})
+	if err != nil {
+		return &RemoteError{op: "put", err: err}
+	}
+	storageClass := ""
+	if cb, ok := backend.(classedBackend); ok {
+		storageClass = cb.StorageClass()
+	}
+	extra := []*badger.Entry{}
+	if remove && locator != vf.Locator {
+		value, err := encodeRecord(&rekeyState{Backend: vf.Backend, Remote: vf.Remote, Locator: vf.Locator})
+		if err != nil {
+			return err
+		}
+		extra = badger.EntriesSet(extra, rekeyKey(vf.Hash, vf.Locator), value)
+	}
+	err = updateRekeyed(kv, vf.Hash, lc.recipientIds(), fi.Size(), func(vf *VaultFile) {
+		vf.Backend = backend.Name()
+		vf.Remote = backend.Target()
+		vf.Locator = locator
+		vf.StorageClass = storageClass
+		vf.PushedAt = time.Now()
+		vf.Missing = false
+	}, extra)
+	if err != nil && locator != vf.Locator {
+		derr := withRetry(func() error {
+			return backend.Delete(locator)
+		})
+		if derr != nil {
+			return &UntrackedObjectError{locator: locator, err: err, derr: derr}
+		}
+	}
+	return err
+}
+
+// Delete the old archives recorded by rekey, keeping the records of the ones
+// that fail to be retried later
+// Return the failures, named by digest
+func deleteRekeyed(kv *badger.KV, backend Backend) ([]FileFailure, error) {
+	pending := make(map[string]rekeyState)
+	keys := []string{}
+	err := forEachWithPrefix(kv, REKEY_PREFIX, func(key string, value []byte) error {
+		var state rekeyState
+		err := decodeRecord(value, &state)
+		if err != nil {
+			return err
+		}
+		pending[key] = state
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return nil, &DbError{op: "read", err: err}
+	}
+	failures := []FileFailure{}
+	for _, key := range keys {
+		state := pending[key]
+		// the key is the digest followed by the locator
+		digest := strings.SplitN(key, KEY_SEP, 2)[0]
+		if err := checkBackend(backend, digest, state.Backend, state.Remote); err != nil {
+			failures = append(failures, FileFailure{Path: digest, Err: err})
+			continue
+		}
+		err := withRetry(func() error {
+			return backend.Delete(state.Locator)
+		})
+		if err != nil {
+			failures = append(failures, FileFailure{Path: digest, Err: &RemoteError{op: "delete", err: err}})
+			continue
+		}
+		err = kv.Delete([]byte(REKEY_PREFIX + key))
+		if err != nil {
+			return failures, &DbError{op: "write", err: err}
+		}
+	}
+	return failures, nil
+}
+
+// Rekey re-encrypts the selected files to the current recipients, which are
+// the signing key and the recipients config
+// Files already encrypted to them are skipped, so an interrupted rekey is
+// resumed by running it again. The archives of a batch are retrieved at once,
+// and no more batch is started once the context is done
+// Return FailuresError if some files failed to be rekeyed
+func (v *Vault) Rekey(ctx context.Context, opts RekeyOptions) (RekeyResult, error) {
+	result := RekeyResult{Failures: []FileFailure{}}
+	if opts.Batch < 1 {
+		return result, &UsageError{msg: "batch must be at least 1"}
+	}
+	vaultDir := v.baseDirectory()
+	filter, err := newListFilter(vaultDir, ListOptions{Prefix: opts.Prefix, KeyId: opts.KeyId})
+	if err != nil {
+		return result, err
+	}
+	kv, err := LoadBadger(makePath(vaultDir, CONF_DIR, DB))
+	if err != nil {
+		return result, err
+	}
+	defer kv.Close()
+	lc, err := NewLocalContext(v, kv, true)
+	if err != nil {
+		return result, err
+	}
+	prompt, err := promptFromContext(&lc)
+	if err != nil {
+		return result, err
+	}
+	awsCtx, err := NewAWSContext(v)
+	if err != nil {
+		return result, err
+	}
+	backend, err := NewBackend(&awsCtx, opts.Backend)
+	if err != nil {
+		return result, err
+	}
+
+	files, skipped, err := rekeySet(kv, filter, lc.recipientIds())
+	if err != nil {
+		return result, &DbError{op: "read", err: err}
+	}
+	result.Skipped = skipped
+
+	cacheDir := makePath(vaultDir, CONF_DIR, CACHE)
+	tmpDir := makePath(vaultDir, CONF_DIR, TMP)
+	rekeyDir := makePath(tmpDir, "rekey")
+	createEmptyDir(tmpDir)
+	createEmptyDir(rekeyDir)
+	for start := 0; start < len(files); start += opts.Batch {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		end := start + opts.Batch
+		if end > len(files) {
+			end = len(files)
+		}
+		batch := files[start:end]
+		retrieved := make(map[string]string)
+		mismatched := make(map[string]error)
+		for _, vf := range batch {
+			if vf.Locator == "" {
+				continue
+			}
+			if err := checkBackend(backend, vf.Hash, vf.Backend, vf.Remote); err != nil {
+				mismatched[vf.Hash] = err
+				continue
+			}
+			retrieved[vf.Locator] = makePath(tmpDir, vf.Hash)
+		}
+		if len(retrieved) > 0 {
+			progressf(opts.Progress, "Retrieving %d objects\n", len(retrieved))
+		}
+		errs := getBatch(ctx, backend, retrieved)
+		for _, vf := range batch {
+			var err error
+			switch {
+			case vf.Locator == "":
+				err = rekeyCached(&lc, kv, cacheDir, rekeyDir, vf, prompt)
+			case mismatched[vf.Hash] != nil:
+				err = mismatched[vf.Hash]
+			case errs[vf.Locator] != nil:
+				err = &RemoteError{op: "get", err: errs[vf.Locator]}
+			default:
+				err = rekeyPushed(&lc, kv, backend, retrieved[vf.Locator], rekeyDir, vf, prompt, opts.Delete)
+			}
+			if err != nil {
+				result.Failures = append(result.Failures, FileFailure{Path: vf.Hash, Err: err})
+				continue
+			}
+			result.Rekeyed++
+			progressf(opts.Progress, "%s rekeyed\n", vf.Hash)
+		}
+		for _, fn := range retrieved {
+			os.Remove(fn)
+		}
+	}
+
+	// the old archives left by a previous rekey are deleted as well
+	failures, err := deleteRekeyed(kv, backend)
+	result.Failures = append(result.Failures, failures...)
+	if err != nil {
+		return result, err
+	}
+	if len(result.Failures) > 0 {
+		return result, &FailuresError{count: len(result.Failures), what: "files failed to rekey"}
+	}
+	return result, nil
+}
@@ -0,0 +1,91 @@
+package vault
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Rekey the cached and pushed test files to the signing key only
+func TestRekey(t *testing.T) {
+	newPath()
+	newDb()
+	defer os.RemoveAll("test_files/.vault")
+	remoteDir, _ := ioutil.TempDir("", "vault")
+	defer os.RemoveAll(remoteDir)
+	WriteConfig("test_files/.vault/config", map[string]string{"signingkey": "C21B7817", "remote": "file://" + remoteDir})
+	WriteConfig("test_files/.vault/credentials", map[string]string{})
+
+	ctx := newPrivLocalContextForTest()
+	AddCache(context.Background(), &ctx, []string{"test_files/test_file", "test_files/hello"})
+	kv, _ := LoadBadger("test_files/.vault/db")
+	backend, _ := NewLocalBackend(remoteDir)
+	hello, err := getVaultFileByAlias(kv, makePath("test_files", "hello"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = pushFile(kv, backend, "test_files/.vault/cache", hello.Hash); err != nil {
+		t.Fatal(err.Error())
+	}
+	// pretend both files were encrypted to a recipient removed since
+	for _, fn := range []string{"test_file", "hello"} {
+		vf, _ := getVaultFileByAlias(kv, makePath("test_files", fn))
+		vf.KeyIds = []string{"C21B7817", "0B1E4A2C"}
+		insertVaultFile(kv, vf.Hash, vf)
+	}
+	kv.Close()
+
+	v := &Vault{directory: "test_files", passphrase: testPassphrase}
+	result, err := v.Rekey(context.Background(), RekeyOptions{Batch: 10})
+	if err != nil || result.Rekeyed != 2 || result.Skipped != 0 {
+		t.Fatal("expect both files rekeyed: ", result, err)
+	}
+	files, err := v.List(context.Background(), ListOptions{KeyId: "0B1E4A2C"})
+	if err != nil || len(files) != 0 {
+		t.Fatal("no file should be encrypted to the removed recipient: ", files)
+	}
+
+	// a second rekey has nothing left to do
+	result, err = v.Rekey(context.Background(), RekeyOptions{Batch: 1})
+	if err != nil || result.Rekeyed != 0 || result.Skipped != 2 {
+		t.Fatal("expect both files skipped: ", result, err)
+	}
+}
+
+// The old archives recorded by rekey are deleted with their records
+func TestDeleteRekeyed(t *testing.T) {
+	newDb()
+	defer os.RemoveAll("test_files/.vault")
+	remoteDir, _ := ioutil.TempDir("", "vault")
+	defer os.RemoveAll(remoteDir)
+	backend, _ := NewLocalBackend(remoteDir)
+	ioutil.WriteFile(makePath(remoteDir, "old"), []byte("old archive"), 0644)
+	ioutil.WriteFile(makePath(remoteDir, "older"), []byte("older archive"), 0644)
+
+	kv, _ := LoadBadger("test_files/.vault/db")
+	defer kv.Close()
+	// a file rekeyed twice has both of its old archives recorded
+	value, _ := encodeRecord(&rekeyState{Backend: backend.Name(), Locator: "old"})
+	kv.Set(rekeyKey("digest", "old"), value, 0)
+	value, _ = encodeRecord(&rekeyState{Backend: backend.Name(), Locator: "older"})
+	kv.Set(rekeyKey("digest", "older"), value, 0)
+	value, _ = encodeRecord(&rekeyState{Backend: BACKEND_GLACIER, Locator: "archive"})
+	kv.Set(rekeyKey("other", "archive"), value, 0)
+
+	failures, err := deleteRekeyed(kv, backend)
+	if err != nil || len(failures) != 1 || failures[0].Path != "other" {
+		t.Fatal("expect the glacier archive to fail: ", failures, err)
+	}
+	if dirExists(makePath(remoteDir, "old")) || dirExists(makePath(remoteDir, "older")) {
+		t.Fatal("the old archives should be deleted")
+	}
+	value, _ = getValue(kv, rekeyKey("digest", "old"))
+	if value != nil {
+		t.Fatal("the record of the deleted archive should be removed")
+	}
+	value, _ = getValue(kv, rekeyKey("other", "archive"))
+	if value == nil {
+		t.Fatal("the record of the failed archive should be kept")
+	}
+}
@@ -0,0 +1,313 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/dgraph-io/badger"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+type TargetExistsError struct {
+	path string
+}
+
+func (e *TargetExistsError) Error() string {
+	return fmt.Sprintf("%s already exists with a different content", e.path)
+}
+
+// restoreItem is an alias to restore with the VaultFile of its version
+type restoreItem struct {
+	alias string // full path of the alias
+	rel   string // path relative to the vault directory, kept under the target
+	vf    VaultFile
+}
+
+// RestoreOptions tune a restore
+type RestoreOptions struct {
+	At       time.Time // restore the files as they were at this time, now if zero
+	Batch    int       // number of objects retrieved at once
+	Backend  BackendOptions
+	Progress io.Writer // progress messages are written to it, nil for none
+}
+
+// Whether the alias is the prefix itself or under it
+func underPrefix(alias, prefix string) bool {
+	return alias == prefix || strings.HasPrefix(alias, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+// Work out every alias under the prefix as it was at the time, or as it is
+// now if at is zero
+// Aliases added after the time are left out, and so are the aliases without
+// history when a time is given, as the time they were added is unknown
+// Return the aliases to restore, in path order, and the aliases left out for
+// lack of history
+func restoreSet(kv *badger.KV, vaultDir, prefix string, at time.Time) ([]restoreItem, []string, error) {
+	candidates := make(map[string]bool)
+	err := forEachAlias(kv, prefix, func(alias, digest string) error {
+		candidates[alias] = true
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	err = forEachWithPrefix(kv, HISTORY_PREFIX+prefix, func(key string, value []byte) error {
+		candidates[prefix+key] = true
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	aliases := []string{}
+	for alias := range candidates {
+		if underPrefix(alias, prefix) {
+			aliases = append(aliases, alias)
+		}
+	}
+	sort.Strings(aliases)
+
+	items := []restoreItem{}
+	unknown := []string{}
+	for _, alias := range aliases {
+		rel := strings.TrimPrefix(alias, vaultDir+"/")
+		history, err := getHistory(kv, alias)
+		if err != nil {
+			return nil, nil, err
+		}
+		var digest string
+		switch {
+		case len(history) > 0 && at.IsZero():
+			digest = history[len(history)-1].Digest
+		case len(history) > 0:
+			entry, ok := versionAt(history, at)
+			if !ok {
+				continue
+			}
+			digest = entry.Digest
+		case at.IsZero():
+			digest, _, err = getAliasDigest(kv, alias)
+			if err != nil {
+				return nil, nil, err
+			}
+		default:
+			unknown = append(unknown, rel)
+			continue
+		}
+		vf, err := getVaultFile(kv, digest)
+		if err != nil {
+			return nil, nil, err
+		}
+		items = append(items, restoreItem{alias: alias, rel: rel, vf: vf})
+	}
+	return items, unknown, nil
+}
+
+// Decrypt the encrypted file of vf into tmpDir and write it to every target
+// An identical target is left as it is, a different one is not replaced
+func writeRestored(encryptedFn, tmpDir string, vf VaultFile, items []restoreItem, targetDir string,
+	prompt openpgp.PromptFunction, progress io.Writer) []FileFailure {
+	failures := []FileFailure{}
+	failAll := func(err error) []FileFailure {
+		for _, item := range items {
+			failures = append(failures, FileFailure{Path: item.rel, Err: err})
+		}
+		return failures
+	}
+	decryptedFn, err := DecryptFile(encryptedFn, tmpDir, &packet.Config{}, prompt)
+	if err != nil {
+		return failAll(err)
+	}
+	defer os.Remove(decryptedFn)
+	digest, err := localTreeHash(decryptedFn)
+	if err != nil {
+		return failAll(err)
+	}
+	if digest != vf.Hash {
+		return failAll(&ChecksumMismatchError{expected: vf.Hash, actual: digest})
+	}
+	for _, item := range items {
+		target := filepath.Join(targetDir, filepath.FromSlash(item.rel))
+		err := writeRestoredItem(decryptedFn, target, item)
+		if err != nil {
+			failures = append(failures, FileFailure{Path: item.rel, Err: err})
+			continue
+		}
+		progressf(progress, "%s restored\n", item.rel)
+	}
+	return failures
+}
+
+func writeRestoredItem(decryptedFn, target string, item restoreItem) error {
+	if dirExists(target) {
+		digest, err := localTreeHash(target)
+		if err != nil {
+			return err
+		}
+		if digest != item.vf.Hash {
+			return &TargetExistsError{path: target}
+		}
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+	err = copyFile(decryptedFn, target)
+	if err != nil {
+		return err
+	}
+	if meta, ok := item.vf.Meta[item.alias]; ok {
+		return applyFileMeta(target, meta)
+	}
+	return nil
+}
+
+// Restore every alias under the prefix, as it was at the time, into the
+// target directory with its path relative to the vault directory
+// The versions are restored batch by batch, the objects of the pushed
+// versions of a batch are retrieved at once and removed once written, and the
+// versions not pushed yet are restored from the cache
+// No more batch is started once the context is done
+func restoreTree(ctx context.Context, lc *LocalContext, backend Backend, kv *badger.KV, prefix, targetDir string,
+	at time.Time, batch int, progress io.Writer) ([]FileFailure, error) {
+	vaultDir := lc.baseDirectory()
+	items, unknown, err := restoreSet(kv, vaultDir, prefix, at)
+	if err != nil {
+		return nil, err
+	}
+	for _, rel := range unknown {
+		progressf(progress, "%s skipped, it has no history\n", rel)
+	}
+	prompt, err := promptFromContext(lc)
+	if err != nil {
+		return nil, err
+	}
+
+	// group the aliases by digest so that every object is retrieved once
+	byDigest := make(map[string][]restoreItem)
+	digests := []string{}
+	for _, item := range items {
+		if _, ok := byDigest[item.vf.Hash]; !ok {
+			digests = append(digests, item.vf.Hash)
+		}
+		byDigest[item.vf.Hash] = append(byDigest[item.vf.Hash], item)
+	}
+
+	failures := []FileFailure{}
+	fail := func(digest string, err error) {
+		for _, item := range byDigest[digest] {
+			failures = append(failures, FileFailure{Path: item.rel, Err: err})
+		}
+		delete(byDigest, digest)
+	}
+	tmpDir := makePath(vaultDir, CONF_DIR, TMP)
+	createEmptyDir(tmpDir)
+	for start := 0; start < len(digests); start += batch {
+		if err := ctx.Err(); err != nil {
+			return failures, err
+		}
+		end := start + batch
+		if end > len(digests) {
+			end = len(digests)
+		}
+		encrypted := make(map[string]string)
+		files := make(map[string]string)
+		for _, digest := range digests[start:end] {
+			vf := byDigest[digest][0].vf
+			switch {
+			case vf.Locator == "":
+				fn := makePath(vaultDir, CONF_DIR, CACHE, digest)
+				if !dirExists(fn) {
+					fail(digest, &NotPushedError{alias: byDigest[digest][0].alias})
+					continue
+				}
+				encrypted[digest] = fn
+			default:
+				if err := checkBackend(backend, digest, vf.Backend, vf.Remote); err != nil {
+					fail(digest, err)
+					continue
+				}
+				fn := makePath(tmpDir, digest)
+				files[vf.Locator] = fn
+				encrypted[digest] = fn
+			}
+		}
+		if len(files) > 0 {
+			progressf(progress, "Retrieving %d objects\n", len(files))
+		}
+		errs := getBatch(ctx, backend, files)
+		for _, digest := range digests[start:end] {
+			items, ok := byDigest[digest]
+			if !ok {
+				continue
+			}
+			vf := items[0].vf
+			if err, failed := errs[vf.Locator]; failed {
+				fail(digest, &RemoteError{op: "get", err: err})
+			} else {
+				failures = append(failures, writeRestored(encrypted[digest], tmpDir, vf, items, targetDir, prompt, progress)...)
+			}
+			if _, retrieved := files[vf.Locator]; retrieved {
+				os.Remove(encrypted[digest])
+			}
+		}
+	}
+	return failures, nil
+}
+
+// Restore every file under the prefix, relative to the working directory as
+// the files given to Add, into the target directory with its path relative to
+// the vault directory
+// Return the files that failed, and FailuresError if there are any
+func (v *Vault) Restore(ctx context.Context, prefix, targetDir string, opts RestoreOptions) ([]FileFailure, error) {
+	if prefix == "" || targetDir == "" {
+		return nil, &UsageError{msg: "Please specify a prefix and a target directory"}
+	}
+	if opts.Batch < 1 {
+		return nil, &UsageError{msg: "batch must be at least 1"}
+	}
+	vaultDir := v.baseDirectory()
+	rel, err := resolveVaultPath(vaultDir, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if rel == "." {
+		prefix = vaultDir + "/"
+	} else {
+		prefix = makePath(vaultDir, rel)
+	}
+	kv, err := LoadBadger(makePath(vaultDir, CONF_DIR, DB))
+	if err != nil {
+		return nil, err
+	}
+	defer kv.Close()
+	lc, err := NewLocalContext(v, kv, true)
+	if err != nil {
+		return nil, err
+	}
+	awsCtx, err := NewAWSContext(v)
+	if err != nil {
+		return nil, err
+	}
+	backend, err := NewBackend(&awsCtx, opts.Backend)
+	if err != nil {
+		return nil, err
+	}
+	failures, err := restoreTree(ctx, &lc, backend, kv, prefix, targetDir, opts.At, opts.Batch, opts.Progress)
+	if err != nil {
+		return failures, err
+	}
+	if len(failures) > 0 {
+		return failures, &FailuresError{count: len(failures), what: "files failed to restore"}
+	}
+	return failures, nil
+}
@@ -0,0 +1,56 @@
+package vault
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Restore the test files from the cache and from a local backend
+func TestRestoreTree(t *testing.T) {
+	newPath()
+	newDb()
+	defer os.RemoveAll("test_files/.vault")
+	remoteDir, _ := ioutil.TempDir("", "vault")
+	defer os.RemoveAll(remoteDir)
+	targetDir, _ := ioutil.TempDir("", "vault")
+	defer os.RemoveAll(targetDir)
+
+	ctx := newPrivLocalContextForTest()
+	AddCache(context.Background(), &ctx, []string{"test_files/test_file", "test_files/hello"})
+	kv, _ := LoadBadger("test_files/.vault/db")
+	defer kv.Close()
+	backend, _ := NewLocalBackend(remoteDir)
+	hello, err := getVaultFileByAlias(kv, makePath("test_files", "hello"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = pushFile(kv, backend, "test_files/.vault/cache", hello.Hash)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	failures, err := restoreTree(context.Background(), &ctx, backend, kv, "test_files/", targetDir, time.Time{}, 1, nil)
+	if err != nil || len(failures) != 0 {
+		t.Fatal("restore fails: ", failures)
+	}
+	for _, fn := range []string{"hello", "test_file"} {
+		expected, _ := ioutil.ReadFile(makePath("test_files", fn))
+		actual, err := ioutil.ReadFile(filepath.Join(targetDir, fn))
+		if err != nil || string(actual) != string(expected) {
+			t.Fatal("wrong restored content of ", fn)
+		}
+	}
+	if files, _ := ioutil.ReadDir("test_files/.vault/tmp"); len(files) != 0 {
+		t.Fatal("the retrieved objects should be removed: ", len(files))
+	}
+
+	// nothing was added that long ago
+	items, _, err := restoreSet(kv, "test_files", "test_files/", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil || len(items) != 0 {
+		t.Fatal("files added later should be left out")
+	}
+}
@@ -0,0 +1,81 @@
+package vault
+
+import (
+	"math/rand"
+	"net"
+	"time"
+)
+
+import (
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+const (
+	MAX_ATTEMPTS = 5
+	BASE_DELAY   = time.Second
+	MAX_DELAY    = time.Minute
+)
+
+// error codes of failures that may succeed when tried again later
+var retryableCodes = map[string]bool{
+	"Throttling":                  true,
+	"ThrottlingException":         true,
+	"ThrottledException":          true,
+	"RequestThrottled":            true,
+	"RequestLimitExceeded":        true,
+	"SlowDown":                    true,
+	"RequestTimeout":              true,
+	"RequestTimeoutException":     true,
+	"ServiceUnavailable":          true,
+	"ServiceUnavailableException": true,
+	"InternalError":               true,
+	"InternalErrorException":      true,
+	"RequestError":                true, // the request could not be sent
+}
+
+// sleep between two attempts, replaced in tests
+var sleep = time.Sleep
+
+// Whether the error is transient, e.g. throttling, a server side error or a
+// network timeout
+func isRetryable(err error) bool {
+	if rf, ok := err.(awserr.RequestFailure); ok {
+		if rf.StatusCode() >= 500 || rf.StatusCode() == 429 {
+			return true
+		}
+	}
+	if aerr, ok := err.(awserr.Error); ok {
+		return retryableCodes[aerr.Code()]
+	}
+	if nerr, ok := err.(net.Error); ok {
+		return nerr.Timeout()
+	}
+	return false
+}
+
+// Delay before the attempt, exponential in the attempt number with full
+// jitter, so that concurrent workers do not retry in lockstep
+func backoff(attempt int) time.Duration {
+	delay := MAX_DELAY
+	if attempt < 16 && BASE_DELAY<<uint(attempt) < MAX_DELAY {
+		delay = BASE_DELAY << uint(attempt)
+	}
+	return time.Duration(rand.Int63n(int64(delay)))
+}
+
+// Call f until it succeeds, fails with an error that is not retryable, or is
+// tried MAX_ATTEMPTS times
+// Return the last error
+func withRetry(f func() error) error {
+	var err error
+	for attempt := 0; attempt < MAX_ATTEMPTS; attempt++ {
+		if attempt > 0 {
+			sleep(backoff(attempt))
+		}
+		err = f()
+		if err == nil || !isRetryable(err) {
+			return err
+		}
+	}
+	return err
+}
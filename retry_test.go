@@ -0,0 +1,77 @@
+package vault
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type fakeAwsError struct {
+	code   string
+	status int
+}
+
+func (e fakeAwsError) Error() string     { return e.code }
+func (e fakeAwsError) Code() string      { return e.code }
+func (e fakeAwsError) Message() string   { return e.code }
+func (e fakeAwsError) OrigErr() error    { return nil }
+func (e fakeAwsError) StatusCode() int   { return e.status }
+func (e fakeAwsError) RequestID() string { return "" }
+
+func TestIsRetryable(t *testing.T) {
+	if !isRetryable(fakeAwsError{code: "ThrottlingException", status: 400}) {
+		t.Fatal("throttling should be retryable")
+	}
+	if !isRetryable(fakeAwsError{code: "Foo", status: 503}) {
+		t.Fatal("server errors should be retryable")
+	}
+	if isRetryable(fakeAwsError{code: "InvalidParameterValueException", status: 400}) {
+		t.Fatal("invalid parameters should not be retryable")
+	}
+	if isRetryable(errors.New("disk full")) {
+		t.Fatal("local errors should not be retryable")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 100; attempt++ {
+		if delay := backoff(attempt); delay < 0 || delay > MAX_DELAY {
+			t.Fatal("delay out of range: ", delay)
+		}
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	sleep = func(time.Duration) {}
+	defer func() { sleep = time.Sleep }()
+
+	attempts := 0
+	err := withRetry(func() error {
+		attempts++
+		if attempts < 3 {
+			return fakeAwsError{code: "Throttling", status: 400}
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Fatal("expect success on the third attempt, got ", attempts, err)
+	}
+
+	attempts = 0
+	withRetry(func() error {
+		attempts++
+		return fakeAwsError{code: "Throttling", status: 400}
+	})
+	if attempts != MAX_ATTEMPTS {
+		t.Fatal("expect ", MAX_ATTEMPTS, " attempts, got ", attempts)
+	}
+
+	attempts = 0
+	withRetry(func() error {
+		attempts++
+		return errors.New("disk full")
+	})
+	if attempts != 1 {
+		t.Fatal("errors that are not retryable should not be retried")
+	}
+}
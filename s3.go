@@ -0,0 +1,275 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	BACKEND_S3   = "s3"
+	RESTORE_DAYS = 1 // days a restored archive stays readable
+)
+
+// storage classes accepted by the storageclass config
+var storageClasses = map[string]bool{
+	s3.StorageClassStandard:    true,
+	s3.StorageClassStandardIa:  true,
+	s3.StorageClassGlacier:     true,
+	s3.StorageClassDeepArchive: true,
+}
+
+type InvalidStorageClassError struct {
+	class string
+}
+
+func (e *InvalidStorageClassError) Error() string {
+	return fmt.Sprintf("Invalid storage class: %s", e.class)
+}
+
+// Return a new S3 service
+// If endpoint is not empty, the service talks to the S3 compatible server at
+// the endpoint, such as MinIO, with path style addressing
+// The sdk does not retry the requests, the callers retry them withRetry
+func NewS3Service(region, endpoint string) *s3.S3 {
+	config := &aws.Config{
+		Region:     aws.String(region),
+		MaxRetries: aws.Int(0),
+	}
+	if endpoint != "" {
+		config.Endpoint = aws.String(endpoint)
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+	sess := session.Must(session.NewSession(config))
+	return s3.New(sess)
+}
+
+// Whether objects in the storage class must be restored before reading
+func isArchivedClass(class string) bool {
+	return class == s3.StorageClassGlacier || class == s3.StorageClassDeepArchive
+}
+
+// Whether the x-amz-restore header reports a finished restore
+func restoreCompleted(restore *string) bool {
+	return restore != nil && strings.Contains(*restore, `ongoing-request="false"`)
+}
+
+// S3Backend stores the cache objects in a bucket, keyed by their digest
+type S3Backend struct {
+	bucket       string
+	storageClass string
+	opts         BackendOptions
+	service      *s3.S3
+}
+
+func NewS3Backend(region, endpoint, bucket, storageClass string, opts BackendOptions) (*S3Backend, error) {
+	if storageClass == "" {
+		storageClass = s3.StorageClassStandard
+	}
+	if !storageClasses[storageClass] {
+		return nil, &InvalidStorageClassError{class: storageClass}
+	}
+	return &S3Backend{
+		bucket:       bucket,
+		storageClass: storageClass,
+		opts:         opts,
+		service:      NewS3Service(region, endpoint),
+	}, nil
+}
+
+func (b *S3Backend) Name() string {
+	return BACKEND_S3
+}
+
+func (b *S3Backend) Target() string {
+	return b.bucket
+}
+
+func (b *S3Backend) StorageClass() string {
+	return b.storageClass
+}
+
+// Put uploads the file with its name, the digest, as the object key
+func (b *S3Backend) Put(fn string) (string, error) {
+	file, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	key := filepath.Base(fn)
+	input := &s3.PutObjectInput{
+		Bucket:       aws.String(b.bucket),
+		Key:          aws.String(key),
+		Body:         file,
+		StorageClass: aws.String(b.storageClass),
+	}
+	_, err = b.service.PutObject(input)
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// Request a restore of an archived object
+// A restore that is already in progress is not an error
+func (b *S3Backend) restore(key string) error {
+	input := &s3.RestoreObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+		RestoreRequest: &s3.RestoreRequest{
+			Days: aws.Int64(RESTORE_DAYS),
+			GlacierJobParameters: &s3.GlacierJobParameters{
+				Tier: aws.String(b.opts.Tier),
+			},
+		},
+	}
+	err := withRetry(func() error {
+		_, err := b.service.RestoreObject(input)
+		return err
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "RestoreAlreadyInProgress" {
+		return nil
+	}
+	return err
+}
+
+// Head the object
+func (b *S3Backend) headObject(key string) (*s3.HeadObjectOutput, error) {
+	var head *s3.HeadObjectOutput
+	err := withRetry(func() error {
+		var err error
+		head, err = b.service.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(b.bucket),
+			Key:    aws.String(key),
+		})
+		return err
+	})
+	return head, err
+}
+
+// Head the object every interval until its restore is completed, or the
+// context is done
+func (b *S3Backend) waitForRestore(ctx context.Context, key string) error {
+	for {
+		head, err := b.headObject(key)
+		if err != nil {
+			return err
+		}
+		if restoreCompleted(head.Restore) {
+			return nil
+		}
+		if err := sleepContext(ctx, b.opts.Interval); err != nil {
+			return err
+		}
+	}
+}
+
+// Get downloads the object into the file ofn
+// Objects in the GLACIER and DEEP_ARCHIVE storage classes are restored first
+func (b *S3Backend) Get(ctx context.Context, locator, ofn string) error {
+	head, err := b.headObject(locator)
+	if err != nil {
+		return err
+	}
+	if isArchivedClass(aws.StringValue(head.StorageClass)) && !restoreCompleted(head.Restore) {
+		err = b.restore(locator)
+		if err != nil {
+			return err
+		}
+		progressf(b.opts.Progress, "Restore of %s requested, waiting for s3\n", locator)
+		err = b.waitForRestore(ctx, locator)
+		if err != nil {
+			return err
+		}
+	}
+	var resp *s3.GetObjectOutput
+	err = withRetry(func() error {
+		var err error
+		resp, err = b.service.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(b.bucket),
+			Key:    aws.String(locator),
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	writer, err := os.OpenFile(ofn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+	_, err = io.Copy(writer, resp.Body)
+	return err
+}
+
+// GetBatch requests the restore of every archived object first, and then
+// gets them in turn
+func (b *S3Backend) GetBatch(ctx context.Context, files map[string]string) map[string]error {
+	errs := make(map[string]error)
+	for _, locator := range sortedKeys(files) {
+		head, err := b.headObject(locator)
+		if err == nil && isArchivedClass(aws.StringValue(head.StorageClass)) && !restoreCompleted(head.Restore) {
+			err = b.restore(locator)
+		}
+		if err != nil {
+			errs[locator] = err
+		}
+	}
+	for _, locator := range sortedKeys(files) {
+		if _, failed := errs[locator]; failed {
+			continue
+		}
+		if err := b.Get(ctx, locator, files[locator]); err != nil {
+			errs[locator] = err
+		}
+	}
+	return errs
+}
+
+func (b *S3Backend) Delete(locator string) error {
+	_, err := b.service.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(locator),
+	})
+	return err
+}
+
+// List returns every object in the bucket
+// A listing that fails is started over
+func (b *S3Backend) List(ctx context.Context) ([]RemoteObject, time.Time, error) {
+	date := time.Now()
+	var objects []RemoteObject
+	err := withRetry(func() error {
+		objects = []RemoteObject{}
+		input := &s3.ListObjectsV2Input{
+			Bucket: aws.String(b.bucket),
+		}
+		return b.service.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, object := range page.Contents {
+				objects = append(objects, RemoteObject{
+					Locator:     aws.StringValue(object.Key),
+					Description: aws.StringValue(object.StorageClass),
+					Size:        aws.Int64Value(object.Size),
+				})
+			}
+			return true
+		})
+	})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return objects, date, nil
+}
@@ -0,0 +1,29 @@
+package vault
+
+import (
+	"testing"
+)
+
+func TestParseRemote(t *testing.T) {
+	if name, target := parseRemote("photos"); name != BACKEND_GLACIER || target != "photos" {
+		t.Fatal("a remote without backend should be a glacier vault")
+	}
+	if name, target := parseRemote("s3://my-bucket"); name != BACKEND_S3 || target != "my-bucket" {
+		t.Fatal("wrong s3 remote: ", name, target)
+	}
+}
+
+func TestRestoreCompleted(t *testing.T) {
+	ongoing := `ongoing-request="true"`
+	done := `ongoing-request="false", expiry-date="Fri, 23 Dec 2012 00:00:00 GMT"`
+	if restoreCompleted(nil) || restoreCompleted(&ongoing) || !restoreCompleted(&done) {
+		t.Fatal("wrong restore state")
+	}
+}
+
+func TestInvalidStorageClass(t *testing.T) {
+	_, err := NewS3Backend("us-east-1", "", "bucket", "FOO", DefaultBackendOptions())
+	if _, ok := err.(*InvalidStorageClassError); !ok {
+		t.Fatal("expect invalid storage class error")
+	}
+}
@@ -0,0 +1,251 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+import (
+	"github.com/dgraph-io/badger"
+)
+
+// SCHEMA_VERSION is the version of the records written by this version of
+// vault, the catalog is migrated to it when it is opened
+// Version 0 is a catalog written before versioning, without a schema key and
+// with raw json records
+const (
+	SCHEMA_VERSION = 2
+	SCHEMA_KEY     = "schema" + KEY_SEP + "version"
+)
+
+type UnsupportedSchemaError struct {
+	version int
+}
+
+func (e *UnsupportedSchemaError) Error() string {
+	return fmt.Sprintf("The vault db schema version %d is newer than the supported version %d, please upgrade vault",
+		e.version, SCHEMA_VERSION)
+}
+
+// recordEnvelope wraps every json record with the schema version it was
+// written with
+type recordEnvelope struct {
+	Schema int             `json:"schema"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// Encode a record in an envelope of the current schema version
+func encodeRecord(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&recordEnvelope{Schema: SCHEMA_VERSION, Data: data})
+}
+
+// Decode a record into v
+// Records written before versioning have no envelope and are decoded as they
+// are
+func decodeRecord(b []byte, v interface{}) error {
+	envelope := recordEnvelope{}
+	err := json.Unmarshal(b, &envelope)
+	if err != nil || envelope.Data == nil {
+		return json.Unmarshal(b, v)
+	}
+	if envelope.Schema > SCHEMA_VERSION {
+		return &UnsupportedSchemaError{version: envelope.Schema}
+	}
+	return json.Unmarshal(envelope.Data, v)
+}
+
+// Get the schema version of the catalog, 0 if it has none
+func getSchemaVersion(kv *badger.KV) (int, error) {
+	value, err := getValue(kv, []byte(SCHEMA_KEY))
+	if err != nil {
+		return 0, err
+	}
+	if value == nil {
+		return 0, nil
+	}
+	return strconv.Atoi(string(value))
+}
+
+// migration upgrades the catalog from the previous schema version to version
+type migration struct {
+	version     int
+	description string
+	// entries returns the changes of the migration, which are written at
+	// once along with the new schema version
+	entries func(kv *badger.KV) ([]*badger.Entry, error)
+}
+
+// migrations in version order, one for every schema version
+var migrations = []migration{
+	{1, "wrap the records in versioned envelopes, convert glacier ids and index the aliases", migrateEnvelopes},
+	{2, "convert the single key ids into recipient lists", migrateKeyIds},
+}
+
+// Wrap every json record in an envelope, convert the legacy glacier ids of
+// the VaultFile records and build the alias index
+func migrateEnvelopes(kv *badger.KV) ([]*badger.Entry, error) {
+	entries := []*badger.Entry{}
+	itr := kv.NewIterator(badger.DefaultIteratorOptions)
+	for itr.Rewind(); itr.Valid(); itr.Next() {
+		item := itr.Item()
+		key := append([]byte{}, item.Key()...)
+		raw, err := itemValue(item)
+		if err != nil {
+			itr.Close()
+			return nil, err
+		}
+		var value []byte
+		switch {
+		case isVaultFileKey(string(key)):
+			var vf VaultFile
+			vf, err = decodeVaultFile(raw)
+			if err == nil {
+				value, err = encodeRecord(&vf)
+			}
+		case hasKeyPrefix(key, UPLOAD_PREFIX, STAT_PREFIX, HISTORY_PREFIX):
+			var record json.RawMessage
+			err = decodeRecord(raw, &record)
+			if err == nil {
+				value, err = encodeRecord(&record)
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			itr.Close()
+			return nil, fmt.Errorf("record %s: %s", key, err.Error())
+		}
+		entries = badger.EntriesSet(entries, key, value)
+	}
+	itr.Close()
+	indexEntries, _, err := aliasIndexEntries(kv)
+	if err != nil {
+		return nil, err
+	}
+	return append(entries, indexEntries...), nil
+}
+
+// Move the single key id of every VaultFile record into its recipient list
+func migrateKeyIds(kv *badger.KV) ([]*badger.Entry, error) {
+	entries := []*badger.Entry{}
+	itr := kv.NewIterator(badger.DefaultIteratorOptions)
+	defer itr.Close()
+	for itr.Rewind(); itr.Valid(); itr.Next() {
+		item := itr.Item()
+		key := string(item.Key())
+		if !isVaultFileKey(key) {
+			continue
+		}
+		value, err := itemValue(item)
+		if err != nil {
+			return nil, err
+		}
+		var raw VaultFile
+		err = decodeRecord(value, &raw)
+		if err != nil {
+			return nil, fmt.Errorf("record %s: %s", key, err.Error())
+		}
+		if raw.KeyId == "" {
+			continue
+		}
+		vf, err := decodeVaultFile(value)
+		if err != nil {
+			return nil, fmt.Errorf("record %s: %s", key, err.Error())
+		}
+		value, err = encodeRecord(&vf)
+		if err != nil {
+			return nil, err
+		}
+		entries = badger.EntriesSet(entries, []byte(key), value)
+	}
+	return entries, nil
+}
+
+// Whether the kv has no record at all
+func isEmptyKV(kv *badger.KV) bool {
+	itr := kv.NewIterator(badger.DefaultIteratorOptions)
+	defer itr.Close()
+	itr.Rewind()
+	return !itr.Valid()
+}
+
+// Whether the key starts with one of the prefixes
+func hasKeyPrefix(key []byte, prefixes ...string) bool {
+	for _, prefix := range prefixes {
+		if len(key) >= len(prefix) && string(key[:len(prefix)]) == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// Run the migrations from the schema version of the catalog up to the current
+// one, calling report before each of them with the number of changed records
+// A dry run only reports the migrations
+// Return the number of migrations run
+func migrateKV(kv *badger.KV, dryRun bool, report func(m migration, changes int)) (int, error) {
+	version, err := getSchemaVersion(kv)
+	if err != nil {
+		return 0, err
+	}
+	if version > SCHEMA_VERSION {
+		return 0, &UnsupportedSchemaError{version: version}
+	}
+	if version == 0 && isEmptyKV(kv) {
+		// a new catalog is written in the current schema from the start
+		if dryRun {
+			return 0, nil
+		}
+		return 0, kv.Set([]byte(SCHEMA_KEY), []byte(strconv.Itoa(SCHEMA_VERSION)), 0)
+	}
+	count := 0
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		entries, err := m.entries(kv)
+		if err != nil {
+			return count, err
+		}
+		report(m, len(entries))
+		count++
+		if dryRun {
+			continue
+		}
+		entries = badger.EntriesSet(entries, []byte(SCHEMA_KEY), []byte(strconv.Itoa(m.version)))
+		err = writeBatch(kv, entries)
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// Migrate the vault db to the current schema version, calling report before
+// each migration with its version, its description and the number of changed
+// records
+// A dry run only reports the migrations
+// Return the number of migrations run
+func (v *Vault) Migrate(ctx context.Context, dryRun bool, report func(version int, description string, changes int)) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	kv, err := openBadger(makePath(v.baseDirectory(), CONF_DIR, DB))
+	if err != nil {
+		return 0, err
+	}
+	defer kv.Close()
+	n, err := migrateKV(kv, dryRun, func(m migration, changes int) {
+		report(m.version, m.description, changes)
+	})
+	if err != nil {
+		return n, &DbError{op: "migrate", err: err}
+	}
+	return n, nil
+}
@@ -0,0 +1,62 @@
+package vault
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// A catalog written before versioning is migrated to the current schema
+func TestMigrateLegacyCatalog(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "vault")
+	defer os.RemoveAll(dir)
+	kv, _ := openBadger(dir)
+	defer kv.Close()
+	kv.Set([]byte("1"), []byte(`{"hash":"1","aliases":["/vault/a"],"glacier":"archive-1","keyid":"C21B7817"}`), 0)
+	kv.Set([]byte(STAT_PREFIX+"/vault/a"), []byte(`{"size":3,"digest":"1"}`), 0)
+
+	report := func(m migration, changes int) {}
+	n, err := migrateKV(kv, true, report)
+	if err != nil || n != len(migrations) {
+		t.Fatal("a dry run should report the migration: ", err)
+	}
+	if version, _ := getSchemaVersion(kv); version != 0 {
+		t.Fatal("a dry run should not write anything")
+	}
+
+	n, err = migrateKV(kv, false, report)
+	if err != nil || n != len(migrations) {
+		t.Fatal("error migrating: ", err)
+	}
+	if version, _ := getSchemaVersion(kv); version != SCHEMA_VERSION {
+		t.Fatal("wrong schema version: ", version)
+	}
+	value, _ := getValue(kv, []byte("1"))
+	envelope := recordEnvelope{}
+	if err := json.Unmarshal(value, &envelope); err != nil || envelope.Schema != SCHEMA_VERSION {
+		t.Fatal("records should be wrapped in an envelope")
+	}
+	fields := make(map[string]interface{})
+	json.Unmarshal(envelope.Data, &fields)
+	if _, ok := fields["keyid"]; ok {
+		t.Fatal("the key id should be moved into the recipients")
+	}
+	vf, err := getVaultFileByAlias(kv, "/vault/a")
+	if err != nil || vf.Backend != BACKEND_GLACIER || vf.Locator != "archive-1" || len(vf.KeyIds) != 1 {
+		t.Fatal("wrong migrated record")
+	}
+	record, found, err := getStatRecord(kv, "/vault/a")
+	if err != nil || !found || record.Size != 3 {
+		t.Fatal("wrong migrated stat record")
+	}
+
+	if n, err = migrateKV(kv, false, report); err != nil || n != 0 {
+		t.Fatal("an up to date catalog should not be migrated")
+	}
+	kv.Set([]byte(SCHEMA_KEY), []byte(strconv.Itoa(SCHEMA_VERSION+1)), 0)
+	if _, err = migrateKV(kv, false, report); err == nil {
+		t.Fatal("expect error for a newer schema")
+	}
+}
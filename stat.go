@@ -0,0 +1,71 @@
+package vault
+
+import (
+	"os"
+)
+
+import (
+	"github.com/dgraph-io/badger"
+)
+
+const STAT_PREFIX = "stat" + KEY_SEP
+
+// StatRecord is the file status of an alias when it was last added
+// A file whose status is unchanged is not read again by add
+type StatRecord struct {
+	Size   int64  `json:"size"`
+	Mtime  int64  `json:"mtime"` // modification time in unix nanoseconds
+	Ctime  int64  `json:"ctime"` // status change time in unix nanoseconds
+	Inode  uint64 `json:"inode"`
+	Digest string `json:"digest"` // digest of the file when it was added
+}
+
+// sysInfo is the part of the file status that depends on the system
+// The owner ids are -1 where the system has none
+type sysInfo struct {
+	ctime int64 // status change time in unix nanoseconds
+	inode uint64
+	uid   int
+	gid   int
+}
+
+func newStatRecord(fi os.FileInfo) StatRecord {
+	sys := sysStat(fi)
+	return StatRecord{
+		Size:  fi.Size(),
+		Mtime: fi.ModTime().UnixNano(),
+		Ctime: sys.ctime,
+		Inode: sys.inode,
+	}
+}
+
+// Whether both records describe the same unchanged file
+func (r StatRecord) unchanged(other StatRecord) bool {
+	return r.Size == other.Size && r.Mtime == other.Mtime && r.Ctime == other.Ctime && r.Inode == other.Inode
+}
+
+func putStatRecord(kv *badger.KV, alias string, record StatRecord) error {
+	value, err := encodeRecord(&record)
+	if err != nil {
+		return err
+	}
+	return kv.Set([]byte(STAT_PREFIX+alias), value, 0)
+}
+
+// Get the stat record of the alias
+// Return false if the alias was never added
+func getStatRecord(kv *badger.KV, alias string) (StatRecord, bool, error) {
+	value, err := getValue(kv, []byte(STAT_PREFIX+alias))
+	if err != nil {
+		return StatRecord{}, false, err
+	}
+	if value == nil {
+		return StatRecord{}, false, nil
+	}
+	record := StatRecord{}
+	err = decodeRecord(value, &record)
+	if err != nil {
+		return StatRecord{}, false, err
+	}
+	return record, true, nil
+}
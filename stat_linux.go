@@ -0,0 +1,20 @@
+package vault
+
+import (
+	"os"
+	"syscall"
+)
+
+// Get the system specific status of the file
+func sysStat(fi os.FileInfo) sysInfo {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return sysInfo{uid: -1, gid: -1}
+	}
+	return sysInfo{
+		ctime: st.Ctim.Nano(),
+		inode: st.Ino,
+		uid:   int(st.Uid),
+		gid:   int(st.Gid),
+	}
+}
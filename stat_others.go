@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package vault
+
+import (
+	"os"
+)
+
+// The status change time, the inode and the owner are not available, only the
+// size and the modification time are compared
+func sysStat(fi os.FileInfo) sysInfo {
+	return sysInfo{uid: -1, gid: -1}
+}
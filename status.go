@@ -0,0 +1,128 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+import (
+	"github.com/dgraph-io/badger"
+)
+
+const (
+	STATUS_UNTRACKED = "untracked"
+	STATUS_MODIFIED  = "modified"
+	STATUS_DELETED   = "deleted"
+)
+
+// Get the digest of the file, reading it only if its status changed since it
+// was last added
+func currentDigest(kv *badger.KV, path, alias string, fi os.FileInfo) (string, error) {
+	record, found, err := getStatRecord(kv, alias)
+	if err != nil {
+		return "", err
+	}
+	if found && record.Digest != "" && record.unchanged(newStatRecord(fi)) {
+		return record.Digest, nil
+	}
+	return localTreeHash(path)
+}
+
+// Compare the files under the vault directory with the catalog
+// Return the paths relative to the vault directory grouped by their status,
+// which is one of untracked, modified and deleted, or the state of the
+// VaultFile of the current version when the file is identical to it
+func computeStatus(kv *badger.KV, baseDir string, m *Matcher) (map[string][]string, error) {
+	// the digest of the current version of every alias
+	aliases := make(map[string]string)
+	err := forEachAlias(kv, "", func(alias, digest string) error {
+		aliases[alias] = digest
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report := make(map[string][]string)
+	seen := make(map[string]bool)
+	err = filepath.Walk(baseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := vaultRelativePath(baseDir, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == CONF_DIR || (path != baseDir && m.SkipDir(rel)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || !m.Match(rel) {
+			return nil
+		}
+		alias := makePath(baseDir, rel)
+		seen[alias] = true
+		current, ok := aliases[alias]
+		if !ok {
+			report[STATUS_UNTRACKED] = append(report[STATUS_UNTRACKED], rel)
+			return nil
+		}
+		digest, err := currentDigest(kv, path, alias, info)
+		if err != nil {
+			return err
+		}
+		status := STATUS_MODIFIED
+		if digest == current {
+			vf, err := getVaultFile(kv, current)
+			if err != nil {
+				return err
+			}
+			status = vf.State()
+		}
+		report[status] = append(report[status], rel)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for alias := range aliases {
+		if !seen[alias] && !dirExists(alias) {
+			rel := strings.TrimPrefix(alias, baseDir+"/")
+			report[STATUS_DELETED] = append(report[STATUS_DELETED], rel)
+		}
+	}
+	sort.Strings(report[STATUS_DELETED])
+	return report, nil
+}
+
+// Status compares the files under the vault directory with the catalog
+// Return the paths relative to the vault directory grouped by their status,
+// which is one of STATUS_UNTRACKED, STATUS_MODIFIED and STATUS_DELETED, or the
+// state of the VaultFile the file is identical to
+func (v *Vault) Status(ctx context.Context) (map[string][]string, error) {
+	baseDir := v.baseDirectory()
+	ignores, err := readIgnoreFile(makePath(baseDir, IGNORE_FILE))
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", IGNORE_FILE, err)
+	}
+	m, err := NewMatcher(ignores, []string{}, []string{})
+	if err != nil {
+		return nil, &ConfigError{key: IGNORE_FILE, value: err.Error()}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	kv, err := LoadBadger(makePath(baseDir, CONF_DIR, DB))
+	if err != nil {
+		return nil, err
+	}
+	defer kv.Close()
+	return computeStatus(kv, baseDir, m)
+}
@@ -0,0 +1,58 @@
+package vault
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestComputeStatus(t *testing.T) {
+	baseDir, _ := ioutil.TempDir("", "vault")
+	defer os.RemoveAll(baseDir)
+	os.MkdirAll(makePath(baseDir, CONF_DIR, DB), 0755)
+	kv, _ := LoadBadger(makePath(baseDir, CONF_DIR, DB))
+	defer kv.Close()
+
+	write := func(name, content string) string {
+		fn := makePath(baseDir, name)
+		ioutil.WriteFile(fn, []byte(content), 0664)
+		digest, _ := localTreeHash(fn)
+		return digest
+	}
+	cached := write("cached", "cached")
+	pushed := write("pushed", "pushed")
+	old := write("modified", "old")
+	write("modified", "new")
+	write("untracked", "untracked")
+	first := write("reverted", "first")
+	second := write("reverted", "second")
+	write("reverted", "first")
+	write("ignored.tmp", "ignored")
+
+	insertVaultFile(kv, cached, VaultFile{Hash: cached, Aliases: []string{makePath(baseDir, "cached")}})
+	insertVaultFile(kv, pushed, VaultFile{Hash: pushed, Aliases: []string{makePath(baseDir, "pushed")},
+		Backend: BACKEND_GLACIER, Locator: "archive-1"})
+	// reverted to a version older than the current one
+	insertVaultFile(kv, first, VaultFile{Hash: first, Aliases: []string{makePath(baseDir, "reverted")}})
+	insertVaultFile(kv, second, VaultFile{Hash: second, Aliases: []string{makePath(baseDir, "reverted")}}, makePath(baseDir, "reverted"))
+	insertVaultFile(kv, old, VaultFile{Hash: old, Aliases: []string{makePath(baseDir, "modified"), makePath(baseDir, "deleted")}})
+
+	m, _ := NewMatcher([]string{"*.tmp"}, []string{}, []string{})
+	report, err := computeStatus(kv, baseDir, m)
+	if err != nil {
+		t.Fatal("error computing status: ", err.Error())
+	}
+	expected := map[string][]string{
+		STATUS_UNTRACKED: {"untracked"},
+		STATUS_MODIFIED:  {"modified", "reverted"},
+		STATUS_DELETED:   {"deleted"},
+		STATE_CACHED:     {"cached"},
+		STATE_PUSHED:     {"pushed"},
+	}
+	for status, paths := range expected {
+		if strings.Join(report[status], ",") != strings.Join(paths, ",") {
+			t.Fatal("wrong ", status, " files: ", report[status])
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package vault
+
+import (
+	"context"
+	"time"
+)
+
+import (
+	"github.com/dgraph-io/badger"
+)
+
+// Compare the VaultFile records of a backend target against its remote
+// listing taken at date
+// Records are marked missing or found again according to the listing, and
+// the updated records are saved and returned
+// Records pushed after the date may be absent from the listing and are left
+// as they are, records without a target are taken to be on this one and get
+// its target once found
+// Remote objects without a record are returned as unknown
+func reconcileInventory(kv *badger.KV, backend, target string, objects []RemoteObject, date time.Time) ([]VaultFile, []RemoteObject, error) {
+	remote := make(map[string]bool)
+	for _, object := range objects {
+		remote[object.Locator] = true
+	}
+	known := make(map[string]bool)
+	updated := []VaultFile{}
+	changed := []VaultFile{}
+	err := forEachVaultFile(kv, func(key string, vf VaultFile) {
+		if vf.Locator == "" || vf.Backend != backend {
+			return
+		}
+		if vf.Remote != "" && vf.Remote != target {
+			return
+		}
+		known[vf.Locator] = true
+		if vf.PushedAt.After(date) {
+			return
+		}
+		missing := !remote[vf.Locator]
+		adopted := !missing && vf.Remote == ""
+		if adopted {
+			vf.Remote = target
+		}
+		if missing != vf.Missing {
+			vf.Missing = missing
+			updated = append(updated, vf)
+			changed = append(changed, vf)
+		} else if adopted {
+			changed = append(changed, vf)
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, vf := range changed {
+		err = insertVaultFile(kv, vf.Hash, vf)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	unknown := []RemoteObject{}
+	for _, object := range objects {
+		if !known[object.Locator] {
+			unknown = append(unknown, object)
+		}
+	}
+	return updated, unknown, nil
+}
+
+// UpdateResult is the outcome of an update
+type UpdateResult struct {
+	Remote  string         // the remote listed
+	Objects int            // number of objects on the remote
+	Updated []VaultFile    // records marked missing or found again
+	Unknown []RemoteObject // remote objects without a record
+}
+
+// Update lists the objects on the remote backend and updates the local data
+// store accordingly
+func (v *Vault) Update(ctx context.Context, opts BackendOptions) (UpdateResult, error) {
+	result := UpdateResult{}
+	awsCtx, err := NewAWSContext(v)
+	if err != nil {
+		return result, err
+	}
+	result.Remote = awsCtx.remote()
+	backend, err := NewBackend(&awsCtx, opts)
+	if err != nil {
+		return result, err
+	}
+	objects, date, err := backend.List(ctx)
+	if err != nil {
+		return result, &RemoteError{op: "list", err: err}
+	}
+	result.Objects = len(objects)
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+
+	kv, err := LoadBadger(makePath(v.baseDirectory(), CONF_DIR, DB))
+	if err != nil {
+		return result, err
+	}
+	defer kv.Close()
+	result.Updated, result.Unknown, err = reconcileInventory(kv, backend.Name(), backend.Target(), objects, date)
+	if err != nil {
+		return result, &DbError{op: "update", err: err}
+	}
+	return result, nil
+}
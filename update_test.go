@@ -0,0 +1,58 @@
+package vault
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReconcileInventory(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "vault")
+	defer os.RemoveAll(dir)
+	kv, _ := LoadBadger(dir)
+	defer kv.Close()
+	insertVaultFile(kv, "1", VaultFile{Hash: "1", Backend: BACKEND_GLACIER, Locator: "archive-1"})
+	insertVaultFile(kv, "2", VaultFile{Hash: "2", Backend: BACKEND_GLACIER, Locator: "archive-2"})
+	insertVaultFile(kv, "3", VaultFile{Hash: "3", Backend: BACKEND_GLACIER, Locator: "archive-3", Missing: true})
+	insertVaultFile(kv, "4", VaultFile{Hash: "4"})
+	date := time.Now().Add(-24 * time.Hour)
+	// pushed after the inventory was taken
+	insertVaultFile(kv, "6", VaultFile{Hash: "6", Backend: BACKEND_GLACIER, Remote: "photos", Locator: "archive-6", PushedAt: time.Now()})
+	// pushed to another vault
+	insertVaultFile(kv, "7", VaultFile{Hash: "7", Backend: BACKEND_GLACIER, Remote: "music", Locator: "archive-7"})
+
+	objects := []RemoteObject{
+		{Locator: "archive-1"},
+		{Locator: "archive-3"},
+		{Locator: "archive-5"},
+	}
+	updated, unknown, err := reconcileInventory(kv, BACKEND_GLACIER, "photos", objects, date)
+	if err != nil {
+		t.Fatal("error reconciling: ", err.Error())
+	}
+	if len(updated) != 2 {
+		t.Fatal("expect 2 updated records, got ", len(updated))
+	}
+	if len(unknown) != 1 || unknown[0].Locator != "archive-5" {
+		t.Fatal("expect archive-5 to be unknown")
+	}
+	if vf, _ := getVaultFile(kv, "2"); !vf.Missing {
+		t.Fatal("2 should be missing")
+	}
+	if vf, _ := getVaultFile(kv, "3"); vf.Missing {
+		t.Fatal("3 should be found again")
+	}
+	if vf, _ := getVaultFile(kv, "4"); vf.Missing {
+		t.Fatal("unpushed file cannot be missing")
+	}
+	if vf, _ := getVaultFile(kv, "6"); vf.Missing {
+		t.Fatal("6 was pushed after the inventory")
+	}
+	if vf, _ := getVaultFile(kv, "7"); vf.Missing {
+		t.Fatal("7 is in another vault")
+	}
+	if vf, _ := getVaultFile(kv, "1"); vf.Remote != "photos" {
+		t.Fatal("1 should be recorded in the vault listed")
+	}
+}
@@ -1,12 +1,21 @@
-package main
+// Package vault encrypts local files with OpenPGP into a cache, and stores
+// them on a remote such as Glacier, S3 or a local directory
+// A vault is opened with Open, and its commands take a context.Context which
+// stops them between two files when it is done
+package vault
 
 import (
 	"fmt"
-	"log"
-	"os"
+	"io"
+	"path/filepath"
+	"strconv"
 	"strings"
 )
 
+import (
+	"github.com/dgraph-io/badger"
+)
+
 // KeyIdProvider provides the openpgp key id
 // The key id can be 64 bit long in hex or last 32 long bit in hex
 type KeyIdProvider interface {
@@ -59,14 +68,40 @@ func NewPrivatePgpInfo(keyId string, passphrase []byte) PrivatePgpInfo {
 	return PrivatePgpInfo{keyId: keyId, passphrase: passphrase}
 }
 
+// PassphraseFunc asks the passphrase of the signing key
+type PassphraseFunc func() ([]byte, error)
+
+// Vault is a directory governed by a .vault config folder
 type Vault struct {
-	directory string
+	directory  string
+	passphrase PassphraseFunc // nil if the signing key has no passphrase
+}
+
+// Write a progress message of a command to w, nowhere if w is nil
+func progressf(w io.Writer, format string, a ...interface{}) {
+	if w != nil {
+		fmt.Fprintf(w, format, a...)
+	}
 }
 
 func (v *Vault) baseDirectory() string {
 	return v.directory
 }
 
+// Dir returns the vault directory, the one holding the .vault config folder
+func (v *Vault) Dir() string {
+	return v.directory
+}
+
+// Get the passphrase of the signing key, empty if the vault has no
+// PassphraseFunc
+func (v *Vault) askPassphrase() ([]byte, error) {
+	if v.passphrase == nil {
+		return []byte{}, nil
+	}
+	return v.passphrase()
+}
+
 type NoVaultFoundError struct {
 	dir string
 }
@@ -88,29 +123,31 @@ func recursiveDirExists(pathArray []string) (string, bool) {
 	return recursiveDirExists(pathArray[:len(pathArray)-1])
 }
 
-// setBaseDirectory sets the base vault directory for the vault object
-// If no vault is found, return no vault found error
-//func (v *Vault) setBaseDirectory() error {
-func NewVault() (Vault, error) {
-	cwd, err := os.Getwd()
+// Open the vault governing dir, starting from dir and going up one by one
+// f asks the passphrase of the signing key when a command needs the private
+// key, it may be nil if the key has no passphrase or only public key commands
+// are run
+func Open(dir string, f PassphraseFunc) (*Vault, error) {
+	abs, err := filepath.Abs(dir)
 	if err != nil {
-		return Vault{}, err
+		return nil, err
 	}
-	pathTokens := strings.Split(cwd, "/")
-	dir, exists := recursiveDirExists(pathTokens)
+	pathTokens := strings.Split(abs, "/")
+	found, exists := recursiveDirExists(pathTokens)
 	if !exists {
-		return Vault{}, &NoVaultFoundError{dir: cwd}
+		return nil, &NoVaultFoundError{dir: abs}
 	}
-	v := Vault{directory: dir}
-
-	return v, nil
+	return &Vault{directory: found, passphrase: f}, nil
 }
 
 // LocalContext must be provided when files are added for encryption and saved
 // as cached files
 type LocalContext struct {
-	vault *Vault
-	pgp   PgpProvider
+	vault      *Vault
+	pgp        PgpProvider
+	recipients []string // key ids the files are encrypted to besides the signing key
+	mode       string   // vault mode, empty is MODE_PUBKEY
+	s2kCount   int      // passphrase hash count of a symmetric vault
 }
 
 func (ctx *LocalContext) baseDirectory() string {
@@ -125,31 +162,86 @@ func (ctx LocalContext) pass() []byte {
 	return ctx.pgp.pass()
 }
 
-type getPassphrase func() []byte
+// Whether the files are encrypted with the passphrase only
+func (ctx LocalContext) symmetric() bool {
+	return ctx.mode == MODE_SYMMETRIC
+}
 
-// NewLocalContext creates a new add context object
-// If the add operation requires private key, then mark private as true
-// f is the function to get passphrase
-func NewLocalContext(private bool, f getPassphrase) LocalContext {
-	v, err := NewVault()
-	if err != nil {
-		log.Fatal(err.Error())
+// Get the key ids the files are encrypted to, the signing key first
+// A symmetric vault has none
+func (ctx LocalContext) recipientIds() []string {
+	if ctx.symmetric() {
+		return []string{}
+	}
+	ids := []string{ctx.key()}
+	for _, keyId := range ctx.recipients {
+		if !containsKeyId(ids, keyId) {
+			ids = append(ids, keyId)
+		}
+	}
+	return ids
+}
+
+// Parse the comma separated key ids of the recipients config
+func parseRecipients(value string) []string {
+	keyIds := []string{}
+	for _, keyId := range strings.Split(value, ",") {
+		keyId = strings.TrimSpace(keyId)
+		if keyId != "" {
+			keyIds = append(keyIds, keyId)
+		}
 	}
+	return keyIds
+}
+
+// NewLocalContext creates a new add context object for the vault
+// If the add operation requires private key, then mark private as true, and
+// the passphrase is asked with the PassphraseFunc of the vault
+// A symmetric vault always asks its passphrase, and checks it
+// The mode of the vault is read from its open catalog kv
+func NewLocalContext(v *Vault, kv *badger.KV, private bool) (LocalContext, error) {
 	configPath := makePath(v.baseDirectory(), CONF_DIR, CONFIG)
-	confMap := ReadConfig(configPath)
+	confMap, err := ReadConfig(configPath)
+	if err != nil {
+		return LocalContext{}, err
+	}
+	s2kCount, err := parseS2KCount(confMap["s2kcount"])
+	if err != nil {
+		return LocalContext{}, err
+	}
+	mode, err := getVaultMode(kv)
+	if err != nil {
+		return LocalContext{}, err
+	}
 	var pgpProvider PgpProvider
 	keyId := confMap["signingkey"]
-	if private {
-		passphrase := f()
+	if mode.Mode == MODE_SYMMETRIC {
+		passphrase, err := v.askPassphrase()
+		if err != nil {
+			return LocalContext{}, err
+		}
+		err = mode.checkPassphrase(passphrase)
+		if err != nil {
+			return LocalContext{}, err
+		}
+		pgpProvider = NewPrivatePgpInfo("", passphrase)
+	} else if private {
+		passphrase, err := v.askPassphrase()
+		if err != nil {
+			return LocalContext{}, err
+		}
 		pgpProvider = NewPrivatePgpInfo(keyId, passphrase)
 	} else {
 		pgpProvider = NewPublicPgpInfo(keyId)
 	}
 	addContext := LocalContext{
-		vault: &v,
-		pgp:   pgpProvider,
+		vault:      v,
+		pgp:        pgpProvider,
+		recipients: parseRecipients(confMap["recipients"]),
+		mode:       mode.Mode,
+		s2kCount:   s2kCount,
 	}
-	return addContext
+	return addContext, nil
 }
 
 // AWSContext must be provided for operation Push and Fetch
@@ -160,6 +252,10 @@ type AWSContext struct {
 	key       string // aws access key id
 	sec       string // aws secret access key
 	remoteDir string // namely the bucket for s3, and vault for glacier
+	endpoint  string // S3 compatible endpoint, empty for aws
+	class     string // S3 storage class
+	multipart int64  // files larger than this are uploaded to glacier in parts
+	part      int64  // glacier multipart upload part size
 }
 
 func (aws AWSContext) baseDirectory() string {
@@ -182,19 +278,60 @@ func (aws AWSContext) remote() string {
 	return aws.remoteDir
 }
 
-// NewAWSContext creates a new context for AWS operations
-func NewAWSContext() AWSContext {
-	v, err := NewVault()
-	if err != nil {
-		log.Fatal(err.Error())
+func (aws AWSContext) s3Endpoint() string {
+	return aws.endpoint
+}
+
+func (aws AWSContext) storageClass() string {
+	return aws.class
+}
+
+func (aws AWSContext) multipartMin() int64 {
+	return aws.multipart
+}
+
+func (aws AWSContext) partSize() int64 {
+	return aws.part
+}
+
+// Parse the size config key given in MiB
+// Return def if the value is empty
+func parseSizeMiB(key, value string, def int64) (int64, error) {
+	if value == "" {
+		return def, nil
 	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, &ConfigError{key: key, value: value}
+	}
+	return size * MiB, nil
+}
 
+// NewAWSContext creates a new context for AWS operations on the vault
+func NewAWSContext(v *Vault) (AWSContext, error) {
 	credPath := makePath(v.baseDirectory(), CONF_DIR, CRED)
-	credMap := ReadConfig(credPath)
+	credMap, err := ReadConfig(credPath)
+	if err != nil {
+		return AWSContext{}, err
+	}
 	key := credMap["aws_access_key_id"]
 	sec := credMap["aws_secret_access_key"]
 	confPath := makePath(v.baseDirectory(), CONF_DIR, CONFIG)
-	configMap := ReadConfig(confPath)
+	configMap, err := ReadConfig(confPath)
+	if err != nil {
+		return AWSContext{}, err
+	}
+	multipart, err := parseSizeMiB("multipartsize", configMap["multipartsize"], DEFAULT_MULTIPART_MIN)
+	if err != nil {
+		return AWSContext{}, err
+	}
+	if multipart > MAX_SINGLE_UPLOAD {
+		return AWSContext{}, &ConfigError{key: "multipartsize", value: configMap["multipartsize"]}
+	}
+	part, err := parseSizeMiB("partsize", configMap["partsize"], DEFAULT_PART_SIZE)
+	if err != nil {
+		return AWSContext{}, err
+	}
 	region := configMap["region"]
 	remote := configMap["remote"]
 	return AWSContext{
@@ -203,5 +340,9 @@ func NewAWSContext() AWSContext {
 		key:       key,
 		sec:       sec,
 		remoteDir: remote,
-	}
+		endpoint:  configMap["endpoint"],
+		class:     configMap["storageclass"],
+		multipart: multipart,
+		part:      part,
+	}, nil
 }
@@ -0,0 +1,85 @@
+package vault
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func testPassphrase() ([]byte, error) {
+	return []byte("b88d80170"), nil
+}
+
+// A vault opened from a directory under it adds, lists and logs the files
+func TestOpenAddList(t *testing.T) {
+	newPath()
+	newDb()
+	defer os.RemoveAll("test_files/.vault")
+	WriteConfig("test_files/.vault/config", map[string]string{"signingkey": "C21B7817"})
+
+	v, err := Open("test_files", testPassphrase)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ctx := context.Background()
+	paths, err := v.Add(ctx, []string{"test_files/hello"}, AddOptions{})
+	if err != nil || len(paths) != 1 {
+		t.Fatal("error adding: ", err)
+	}
+	files, err := v.List(ctx, ListOptions{State: STATE_CACHED})
+	if err != nil || len(files) != 1 || files[0].State() != STATE_CACHED {
+		t.Fatal("expect one cached file: ", files, err)
+	}
+	entries, err := v.Log(ctx, "test_files/hello")
+	if err != nil || len(entries) != 1 || entries[0].Digest != files[0].Hash {
+		t.Fatal("expect one version: ", entries, err)
+	}
+
+	// nothing is added once the context is done
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err = v.Add(cancelled, []string{"test_files/test_file"}, AddOptions{}); err != context.Canceled {
+		t.Fatal("expect the add to be cancelled: ", err)
+	}
+}
+
+func TestOpenNoVault(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "vault")
+	defer os.RemoveAll(dir)
+	if _, err := Open(dir, nil); err == nil {
+		t.Fatal("expect no vault found")
+	}
+	v, err := Init(dir, nil, InitOptions{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err = Open(dir, nil); err != nil || v.Dir() == "" {
+		t.Fatal("the initialised vault should open: ", err)
+	}
+	if _, err = Init(dir, nil, InitOptions{}); err == nil {
+		t.Fatal("a vault should not be initialised twice")
+	}
+}
+
+// Glacier takes at most 4 GiB in a single upload, so larger files must be
+// uploaded in parts
+func TestMultipartSizeLimit(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "vault")
+	defer os.RemoveAll(dir)
+	v, err := Init(dir, nil, InitOptions{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	conf := makePath(dir, CONF_DIR, CONFIG)
+	WriteConfig(conf, map[string]string{"multipartsize": "4096"})
+	if ctx, err := NewAWSContext(v); err != nil || ctx.multipartMin() != MAX_SINGLE_UPLOAD {
+		t.Fatal("expect 4 GiB to be accepted: ", err)
+	}
+	WriteConfig(conf, map[string]string{"multipartsize": "4097"})
+	if _, err := NewAWSContext(v); err == nil {
+		t.Fatal("expect more than 4 GiB to be refused")
+	} else if _, ok := err.(*ConfigError); !ok {
+		t.Fatal("expect a config error: ", err)
+	}
+}
@@ -0,0 +1,171 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"time"
+)
+
+import (
+	"github.com/dgraph-io/badger"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// Problem is an integrity problem found by verify
+type Problem struct {
+	Digest string
+	Reason string
+}
+
+// VerifyOptions tune a verify
+type VerifyOptions struct {
+	Remote   bool // also check a sample of the remote objects
+	Sample   int  // number of remote objects to check
+	Backend  BackendOptions
+	Progress io.Writer // progress messages are written to it, nil for none
+}
+
+// Check that every cache file decrypts to its digest and has a record
+func verifyCache(kv *badger.KV, cacheDir string, prompt openpgp.PromptFunction) ([]Problem, error) {
+	files, err := readCacheDir(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+	config := &packet.Config{}
+	problems := []Problem{}
+	for _, fi := range files {
+		digest := fi.Name()
+		vf, err := getVaultFile(kv, digest)
+		if err != nil {
+			problems = append(problems, Problem{digest, "cache file without record"})
+		} else if vf.Hash != digest {
+			problems = append(problems, Problem{digest, "record has hash " + vf.Hash})
+		}
+		actual, err := DecryptTreeHash(makePath(cacheDir, digest), config, prompt)
+		if err != nil {
+			problems = append(problems, Problem{digest, "cannot decrypt cache file: " + err.Error()})
+		} else if actual != digest {
+			problems = append(problems, Problem{digest, "cache file decrypts to " + actual})
+		}
+	}
+	return problems, nil
+}
+
+// Check that every record is either cached or stored on a remote
+func verifyCatalog(kv *badger.KV, cacheDir string) ([]Problem, error) {
+	problems := []Problem{}
+	err := forEachVaultFile(kv, func(key string, vf VaultFile) {
+		if vf.Locator == "" && !dirExists(makePath(cacheDir, key)) {
+			problems = append(problems, Problem{key, "neither cached nor pushed"})
+		}
+		if vf.Missing {
+			problems = append(problems, Problem{key, "missing from the remote inventory"})
+		}
+	})
+	return problems, err
+}
+
+// Retrieve a random sample of the objects on the backend, and check that
+// they decrypt to their digest
+func verifyRemote(ctx context.Context, kv *badger.KV, backend Backend, tmpDir string, sample int, prompt openpgp.PromptFunction,
+	progress io.Writer) ([]Problem, error) {
+	pushed := []VaultFile{}
+	err := forEachVaultFile(kv, func(key string, vf VaultFile) {
+		if vf.Locator != "" && checkBackend(backend, vf.Hash, vf.Backend, vf.Remote) == nil {
+			pushed = append(pushed, vf)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	random.Shuffle(len(pushed), func(i, j int) {
+		pushed[i], pushed[j] = pushed[j], pushed[i]
+	})
+	if sample < len(pushed) {
+		pushed = pushed[:sample]
+	}
+
+	createEmptyDir(tmpDir)
+	config := &packet.Config{}
+	problems := []Problem{}
+	for _, vf := range pushed {
+		if err := ctx.Err(); err != nil {
+			return problems, err
+		}
+		progressf(progress, "Retrieving %s\n", vf.Hash)
+		fn := makePath(tmpDir, vf.Hash)
+		err := backend.Get(ctx, vf.Locator, fn)
+		if err != nil {
+			problems = append(problems, Problem{vf.Hash, "cannot retrieve: " + err.Error()})
+			continue
+		}
+		actual, err := DecryptTreeHash(fn, config, prompt)
+		os.Remove(fn)
+		if err != nil {
+			problems = append(problems, Problem{vf.Hash, "cannot decrypt remote object: " + err.Error()})
+		} else if actual != vf.Hash {
+			problems = append(problems, Problem{vf.Hash, "remote object decrypts to " + actual})
+		}
+	}
+	return problems, nil
+}
+
+// Verify audits the cache, the catalog, and with the Remote option a sample
+// of the remote objects
+// Return the problems found, and FailuresError if there are any
+func (v *Vault) Verify(ctx context.Context, opts VerifyOptions) ([]Problem, error) {
+	baseDir := v.baseDirectory()
+	cacheDir := makePath(baseDir, CONF_DIR, CACHE)
+	kv, err := LoadBadger(makePath(baseDir, CONF_DIR, DB))
+	if err != nil {
+		return nil, err
+	}
+	defer kv.Close()
+	lc, err := NewLocalContext(v, kv, true)
+	if err != nil {
+		return nil, err
+	}
+	prompt, err := promptFromContext(&lc)
+	if err != nil {
+		return nil, err
+	}
+
+	problems, err := verifyCache(kv, cacheDir, prompt)
+	if err != nil {
+		return nil, fmt.Errorf("error verifying the cache: %w", err)
+	}
+	catalogProblems, err := verifyCatalog(kv, cacheDir)
+	if err != nil {
+		return nil, fmt.Errorf("error verifying the catalog: %w", err)
+	}
+	problems = append(problems, catalogProblems...)
+	if opts.Remote {
+		if err := ctx.Err(); err != nil {
+			return problems, err
+		}
+		awsCtx, err := NewAWSContext(v)
+		if err != nil {
+			return problems, err
+		}
+		backend, err := NewBackend(&awsCtx, opts.Backend)
+		if err != nil {
+			return problems, err
+		}
+		tmpDir := makePath(baseDir, CONF_DIR, TMP)
+		remoteProblems, err := verifyRemote(ctx, kv, backend, tmpDir, opts.Sample, prompt, opts.Progress)
+		problems = append(problems, remoteProblems...)
+		if err != nil {
+			return problems, fmt.Errorf("error verifying the remote: %w", err)
+		}
+	}
+
+	if len(problems) > 0 {
+		return problems, &FailuresError{count: len(problems), what: "problems found"}
+	}
+	return problems, nil
+}
@@ -0,0 +1,35 @@
+package vault
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func TestVerifyCache(t *testing.T) {
+	newPath()
+	newDb()
+	defer os.RemoveAll("test_files/.vault")
+	ctx := newPrivLocalContextForTest()
+	AddCache(context.Background(), &ctx, []string{"test_files/test_file", "test_files/hello"})
+	prompt, _ := promptFromContext(&ctx)
+
+	kv, _ := LoadBadger("test_files/.vault/db")
+	defer kv.Close()
+	cacheDir := "test_files/.vault/cache"
+	problems, err := verifyCache(kv, cacheDir, prompt)
+	if err != nil || len(problems) != 0 {
+		t.Fatal("cache should be intact: ", problems, err)
+	}
+	problems, err = verifyCatalog(kv, cacheDir)
+	if err != nil || len(problems) != 0 {
+		t.Fatal("catalog should be intact: ", problems, err)
+	}
+
+	// a record that is neither cached nor pushed
+	insertVaultFile(kv, "lost", VaultFile{Hash: "lost"})
+	problems, _ = verifyCatalog(kv, cacheDir)
+	if len(problems) != 1 || problems[0].Digest != "lost" {
+		t.Fatal("expect a lost record: ", problems)
+	}
+}